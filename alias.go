@@ -0,0 +1,164 @@
+// ALIAS pseudo records: apex flattening resolved at query time
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstream resolver for ALIAS targets outside our zones (edit as needed)
+var aliasUpstream = "1.1.1.1:53"
+
+// how long upstream failures and empty answers are cached
+var aliasNegativeTTL uint32 = 30
+
+type aliasCacheEntry struct {
+	rdata   [][]byte
+	expires time.Time
+}
+
+var aliasCache = make(map[string]aliasCacheEntry)
+var aliasCacheMu sync.Mutex
+
+// expandAlias adds A/AAAA records synthesized from an ALIAS at the same name.
+// real records of the queried type win over the alias. in-zone target records
+// keep their owner name and options (health check, backup, weight) so they
+// are checked and ordered like the target's own answer; answerQuery gives
+// every answer the query name afterwards, as it does for wildcards
+func (z *zoneTree) expandAlias(answers []rr, qType uint16) []rr {
+	if qType != type_a && qType != type_aaaa {
+		return answers
+	}
+	var alias *rr
+	for i, r := range answers {
+		if r.Type_ == qType {
+			return answers
+		}
+		if r.Type_ == type_alias {
+			alias = &answers[i]
+		}
+	}
+	if alias == nil {
+		return answers
+	}
+	target := decode_name(alias.Rdata)
+	recs, ttl := z.resolveAliasTarget(alias.Name, target, qType, 0)
+	for _, r := range recs {
+		r.TTL = min(ttl, alias.TTL)
+		answers = append(answers, r)
+	}
+	return answers
+}
+
+// resolveAliasTarget looks the target up in our own zones if we are authoritative
+// for it, otherwise asks the upstream resolver. upstream answers are owned by
+// name, the alias
+func (z *zoneTree) resolveAliasTarget(name, target string, qType uint16, depth int) ([]rr, uint32) {
+	target = strings.ToLower(fqdn(target))
+	if !z.isAuthoritative(target) {
+		rdatas, ttl := lookupUpstream(target, qType)
+		var recs []rr
+		for _, rd := range rdatas {
+			recs = append(recs, rr{Name: name, Type_: qType, Class: class_in, TTL: ttl, Rdata: rd})
+		}
+		return recs, ttl
+	}
+	if depth > 8 {
+		log.Printf("ALIAS: too many levels resolving %s", target)
+		return nil, 0
+	}
+	var recs []rr
+	ttl := ^uint32(0)
+	for _, r := range z.findZoneRecords(target) {
+		switch r.Type_ {
+		case qType:
+			recs = append(recs, r)
+			ttl = min(ttl, r.TTL)
+		case type_cname, type_alias:
+			if len(recs) == 0 {
+				next, nextTTL := z.resolveAliasTarget(name, decode_name(r.Rdata), qType, depth+1)
+				return next, min(r.TTL, nextTTL)
+			}
+		}
+	}
+	return recs, ttl
+}
+
+// lookupUpstream asks aliasUpstream for target/qType, caching by the answer TTL
+func lookupUpstream(target string, qType uint16) ([][]byte, uint32) {
+	key := target + " " + typeToString(qType)
+	aliasCacheMu.Lock()
+	if e, ok := aliasCache[key]; ok && time.Now().Before(e.expires) {
+		aliasCacheMu.Unlock()
+		return e.rdata, uint32(time.Until(e.expires).Seconds())
+	}
+	aliasCacheMu.Unlock()
+
+	rdatas, ttl, err := queryUpstream(aliasUpstream, target, qType)
+	if err != nil {
+		log.Printf("ALIAS: upstream lookup of %s %s failed: %v", target, typeToString(qType), err)
+		rdatas, ttl = nil, aliasNegativeTTL
+	} else if len(rdatas) == 0 {
+		ttl = aliasNegativeTTL
+	}
+	aliasCacheMu.Lock()
+	aliasCache[key] = aliasCacheEntry{rdata: rdatas, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	aliasCacheMu.Unlock()
+	return rdatas, ttl
+}
+
+// queryUpstream sends a recursive query over udp and returns the rdata of
+// every answer of qType with the lowest ttl seen in the answer section
+func queryUpstream(server, name string, qType uint16) ([][]byte, uint32, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	id := uint16(rand.Intn(1 << 16))
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, dns_header{Id: id, Flags: 1 << 8, Qdcount: 1}) // RD
+	write_name(buf, name)
+	binary.Write(buf, binary.BigEndian, qType)
+	binary.Write(buf, binary.BigEndian, uint16(class_in))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, 0, err
+	}
+
+	resp := make([]byte, 4096)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, 0, err
+		}
+		msg, err := parse_full_msg(resp[:n])
+		if err != nil || msg.Hdr.Id != id || msg.Hdr.Flags&qr_mask == 0 {
+			continue // not our answer, keep waiting
+		}
+		if len(msg.Questions) != 1 || !strings.EqualFold(fqdn(msg.Questions[0].Name), name) || msg.Questions[0].Type_ != qType {
+			continue
+		}
+		if rcode := msg.Hdr.Flags & rcode_mask; rcode != 0 && rcode != 3 { // NOERROR, NXDOMAIN
+			return nil, 0, errors.New("upstream returned rcode " + strconv.Itoa(int(rcode)))
+		}
+		var rdatas [][]byte
+		ttl := ^uint32(0)
+		for _, r := range msg.Answer {
+			ttl = min(ttl, r.TTL)
+			if r.Type_ == qType {
+				rdatas = append(rdatas, r.Rdata)
+			}
+		}
+		return rdatas, ttl, nil
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// startStubResolver answers every A query with 192.0.2.7 (ttl 60) and counts queries
+func startStubResolver(t *testing.T) (string, *int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var count int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&count, 1)
+			hdr, q, err := parse_dns_msg(buf[:n])
+			if err != nil {
+				continue
+			}
+			var answers []rr
+			if q.Type_ == type_a {
+				answers = append(answers, rr{Name: q.Name, Type_: type_a, Class: class_in, TTL: 60, Rdata: net.ParseIP("192.0.2.7").To4()})
+			}
+			resp, _ := build_response(hdr, q, answers, nil)
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), &count
+}
+
+func TestExpandAlias(t *testing.T) {
+	upstream, count := startStubResolver(t)
+	aliasUpstream = upstream
+	aliasCache = make(map[string]aliasCacheEntry)
+
+	soa, _ := parseRdata(type_soa, []string{"ns1.example.com.", "hostmaster.example.com.", "1", "3600", "600", "86400", "300"})
+	target, _ := encodeName("www.example.com.")
+	external, _ := encodeName("hosting.example.net.")
+	zone = zoneFromMap(map[string][]rr{
+		"example.com.": {
+			makeRR("example.com.", type_soa, 3600, soa),
+			makeRR("example.com.", type_alias, 300, target),
+		},
+		"www.example.com.": {
+			{Name: "www.example.com.", Type_: type_a, Class: class_in, TTL: 120, Rdata: net.ParseIP("192.0.2.1").To4()},
+			{Name: "www.example.com.", Type_: type_a, Class: class_in, TTL: 120, Rdata: net.ParseIP("192.0.2.2").To4()},
+		},
+		"shop.example.com.": {
+			makeRR("shop.example.com.", type_alias, 30, external),
+		},
+	})
+
+	got := zone.answerQuery("example.com.", type_a).Answer
+	if len(got) != 2 || got[0].Name != "example.com." || got[0].TTL != 120 {
+		t.Fatalf("in-zone alias: %+v", got)
+	}
+	if atomic.LoadInt32(count) != 0 {
+		t.Error("in-zone alias target should not go upstream")
+	}
+	if got := filterAnswers(type_aaaa, zone.expandAlias(zone.findZoneRecords("example.com."), type_aaaa)); len(got) != 0 {
+		t.Errorf("expected no AAAA records, got %+v", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		got = filterAnswers(type_a, zone.expandAlias(zone.findZoneRecords("shop.example.com."), type_a))
+		if len(got) != 1 || net.IP(got[0].Rdata).String() != "192.0.2.7" {
+			t.Fatalf("external alias: %+v", got)
+		}
+		if got[0].TTL > 30 {
+			t.Errorf("ttl %d should be capped by the alias ttl", got[0].TTL)
+		}
+	}
+	if n := atomic.LoadInt32(count); n != 1 {
+		t.Errorf("expected 1 upstream query thanks to caching, got %d", n)
+	}
+
+	// the ALIAS itself never goes out
+	for _, qType := range []uint16{255, type_alias} {
+		for _, r := range zone.answerQuery("example.com.", qType).Answer {
+			if r.Type_ == type_alias {
+				t.Errorf("query type %d answered with the ALIAS record", qType)
+			}
+		}
+	}
+}
+
+func TestAliasHealth(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"example.com. ALIAS www.example.com. 300",
+		"www.example.com. A 192.0.2.1 60 ; check=tcp port=1",
+		"www.example.com. A 192.0.2.2 60 ; check=tcp port=1",
+	)
+	healthMu.Lock()
+	healthStates = map[string]*healthState{}
+	for _, r := range zone.get("www.example.com.") {
+		healthStates[checkKey(r)] = &healthState{Healthy: net.IP(r.Rdata).String() != "192.0.2.1"}
+	}
+	healthMu.Unlock()
+	t.Cleanup(func() { healthStates = map[string]*healthState{} })
+
+	// the apex gets what the target gets: no dead address
+	for _, name := range []string{"www.example.com.", "example.com."} {
+		got := zone.answerQuery(name, type_a).Answer
+		if len(got) != 1 || net.IP(got[0].Rdata).String() != "192.0.2.2" || got[0].Name != name {
+			t.Errorf("%s: %+v", name, got)
+		}
+	}
+}
@@ -10,7 +10,9 @@ import (
 var analyticsFile = "analytics.log" // used in logAnalyticsEvent and getAnalyticsStats
 var analyticsMu sync.Mutex          // used for file locking
 
-// EventType: "request", "error", "notfound"
+var analyticsSummaryFile = "analytics_summary.json" // written by updateAnalyticsSummary for the web ui
+
+// EventType: "request", "error", "notfound", "refused" (a denied zone transfer or update)
 type AnalyticsEvent struct {
 	Type      string    `json:"type"`
 	Name      string    `json:"name,omitempty"`
@@ -35,9 +37,9 @@ func getAnalyticsStats() (map[string]map[string]int, error) {
 	analyticsMu.Lock()
 	defer analyticsMu.Unlock()
 	stats := map[string]map[string]int{
-		"24h": {"request": 0, "error": 0, "notfound": 0},
-		"7d":  {"request": 0, "error": 0, "notfound": 0},
-		"30d": {"request": 0, "error": 0, "notfound": 0},
+		"24h": {"request": 0, "error": 0, "notfound": 0, "refused": 0},
+		"7d":  {"request": 0, "error": 0, "notfound": 0, "refused": 0},
+		"30d": {"request": 0, "error": 0, "notfound": 0, "refused": 0},
 	}
 	f, err := os.Open(analyticsFile)
 	if err != nil {
@@ -66,7 +68,7 @@ func getAnalyticsStats() (map[string]map[string]int, error) {
 
 func updateAnalyticsSummary() error {
 	stats, _ := getAnalyticsStats()
-	f, err := os.OpenFile("analytics_summary.json", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	f, err := os.OpenFile(analyticsSummaryFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -77,12 +79,12 @@ func updateAnalyticsSummary() error {
 }
 
 func readAnalyticsSummary() (map[string]map[string]int, error) {
-	f, err := os.Open("analytics_summary.json")
+	f, err := os.Open(analyticsSummaryFile)
 	if err != nil {
 		return map[string]map[string]int{
-			"24h": {"request": 0, "error": 0, "notfound": 0},
-			"7d":  {"request": 0, "error": 0, "notfound": 0},
-			"30d": {"request": 0, "error": 0, "notfound": 0},
+			"24h": {"request": 0, "error": 0, "notfound": 0, "refused": 0},
+			"7d":  {"request": 0, "error": 0, "notfound": 0, "refused": 0},
+			"30d": {"request": 0, "error": 0, "notfound": 0, "refused": 0},
 		}, nil
 	}
 	defer f.Close()
@@ -90,9 +92,9 @@ func readAnalyticsSummary() (map[string]map[string]int, error) {
 	err = json.NewDecoder(f).Decode(&stats)
 	if err != nil {
 		return map[string]map[string]int{
-			"24h": {"request": 0, "error": 0, "notfound": 0},
-			"7d":  {"request": 0, "error": 0, "notfound": 0},
-			"30d": {"request": 0, "error": 0, "notfound": 0},
+			"24h": {"request": 0, "error": 0, "notfound": 0, "refused": 0},
+			"7d":  {"request": 0, "error": 0, "notfound": 0, "refused": 0},
+			"30d": {"request": 0, "error": 0, "notfound": 0, "refused": 0},
 		}, nil
 	}
 	return stats, nil
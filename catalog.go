@@ -0,0 +1,269 @@
+// catalog zones (RFC 9432): a zone listing other zones, so secondaries pick up
+// new zones without being configured for each one
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// catalogZone is a catalog we produce: it lists every primary zone of the
+// view as a member, eg
+//
+//	<sha1 of the member name>.zones.catalog.invalid. PTR example.com.
+//
+// and is served like any other zone, so secondaries can AXFR/IXFR it (the
+// transfer ACLs apply)
+type catalogZone struct {
+	Zone string
+	View string // view whose zones are listed and that serves the catalog, "" when there are no views
+
+	view *view
+}
+
+// catalogs we produce
+var catalogs []*catalogZone
+
+// how often the catalogs are checked against the zones
+var catalogInterval = 10 * time.Second
+
+// catalog zones config (to call while dns startup, after the zones are
+// loaded). a catalog that isn't in the zone file yet is created
+func setupCatalogs(cs ...catalogZone) error {
+	var out []*catalogZone
+	for _, c := range cs {
+		c := c
+		if c.Zone == "" {
+			return errors.New("catalog zone needs a zone")
+		}
+		c.Zone = fqdn(strings.ToLower(c.Zone))
+		v, err := configuredView(c.View)
+		if err != nil {
+			return fmt.Errorf("catalog %s: %v", c.Zone, err)
+		}
+		c.view = v
+		out = append(out, &c)
+	}
+	catalogs = out
+	updateCatalogs()
+	return nil
+}
+
+// startCatalogs keeps the catalogs up to date with the zones, forever
+func startCatalogs() {
+	for {
+		time.Sleep(catalogInterval)
+		updateCatalogs()
+	}
+}
+
+// updateCatalogs updates every catalog and saves the ones that changed
+func updateCatalogs() {
+	for _, c := range catalogs {
+		if c.update() {
+			if err := c.view.save(); err != nil {
+				log.Printf("catalog %s: could not save: %v", c.Zone, err)
+			}
+		}
+	}
+}
+
+// update makes the catalog's members the zones of its view: every name with a
+// SOA except secondary zones and catalogs. any difference is one change, so
+// the serial goes up, it can be had by IXFR and NOTIFY goes out. reports
+// whether anything changed
+func (c *catalogZone) update() bool {
+	z := c.view.zone
+	// worked out before taking the zone lock, see secondaryFor
+	var skip []string
+	secondaryMu.Lock()
+	for _, s := range secondaries {
+		if s.tree == z {
+			skip = append(skip, s.Zone)
+		}
+	}
+	secondaryMu.Unlock()
+	for _, other := range catalogs {
+		skip = append(skip, other.Zone)
+	}
+
+	changed := false
+	z.changeWith(c.Zone, func() ([]rr, []rr, bool) {
+		var del, add []rr
+		if _, ok := z.soaLocked(c.Zone); !ok {
+			add = c.skeleton()
+		}
+		want := map[string]rr{}
+		for _, name := range z.namesLocked() {
+			if !hasType(z.rrsLocked(name), type_soa) || isBelowAny(name, skip) {
+				continue
+			}
+			r := catalogMember(c.Zone, name)
+			want[r.Name] = r
+		}
+		zones := "zones." + c.Zone
+		for _, name := range z.namesLocked() {
+			if parentName(name) != zones {
+				continue
+			}
+			for _, r := range z.rrsLocked(name) {
+				if w, ok := want[name]; ok && r.Type_ == type_ptr && bytes.Equal(r.Rdata, w.Rdata) {
+					delete(want, name)
+					continue
+				}
+				del = append(del, r)
+			}
+		}
+		for _, r := range want {
+			add = append(add, r)
+		}
+		sort.Slice(add, func(i, j int) bool { return canonicalLess(add[i].Name, add[j].Name) })
+		changed = len(del) > 0 || len(add) > 0
+		return del, add, changed
+	})
+	return changed
+}
+
+// skeleton is what a new catalog starts with: a SOA and NS that don't point
+// anywhere and the catalog schema version
+func (c *catalogZone) skeleton() []rr {
+	var out []rr
+	for _, line := range []string{
+		c.Zone + " SOA invalid. invalid. 1 3600 600 2147483646 0 0",
+		c.Zone + " NS invalid. 0",
+		"version." + c.Zone + ` TXT "2" 0`,
+	} {
+		r, err := parseRecord(line)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// catalogMember is the PTR that lists zone in the catalog cat. the unique id
+// is the sha1 of the zone's wire name, so it stays the same across restarts
+func catalogMember(cat, zone string) rr {
+	wire, _ := encodeName(zone)
+	sum := sha1.Sum(wire)
+	return makeRR(hex.EncodeToString(sum[:])+".zones."+cat, type_ptr, 0, wire)
+}
+
+// isBelowAny reports whether name is at or below one of the zones
+func isBelowAny(name string, zones []string) bool {
+	for _, z := range zones {
+		if isBelow(name, z) {
+			return true
+		}
+	}
+	return false
+}
+
+// catalogMembers reads the member zones of the catalog at cat in z. members
+// with more than one PTR are left out (RFC 9432 section 4.1)
+func catalogMembers(z *zoneTree, cat string) (map[string]bool, error) {
+	version := false
+	for _, r := range z.get("version." + cat) {
+		version = version || (r.Type_ == type_txt && string(r.Rdata) == "\x012")
+	}
+	if !version {
+		return nil, errors.New("not a version 2 catalog")
+	}
+	members := map[string]bool{}
+	zones := "zones." + cat
+	for _, name := range z.namesBelow(zones) {
+		if parentName(name) != zones {
+			continue
+		}
+		var ptrs []string
+		for _, r := range z.get(name) {
+			if r.Type_ != type_ptr {
+				continue
+			}
+			if member, _, err := readRdataName(r.Rdata, 0); err == nil {
+				ptrs = append(ptrs, strings.ToLower(member))
+			}
+		}
+		if len(ptrs) == 1 {
+			members[ptrs[0]] = true
+		}
+	}
+	return members, nil
+}
+
+// syncCatalog makes the members of a catalog we are a secondary for into
+// secondary zones as well: from the same primary, with the same key, in the
+// same view and saved next to the catalog's file. members that left the
+// catalog are no longer served and their file is removed. zones we already
+// have are left alone
+func (s *secondaryZone) syncCatalog() {
+	members, err := catalogMembers(s.tree, s.Zone)
+	if err != nil {
+		log.Printf("catalog %s: %v", s.Zone, err)
+		return
+	}
+	secondaryMu.Lock()
+	var keep, gone []*secondaryZone
+	for _, m := range secondaries {
+		if m.member == s.Zone && !members[m.Zone] {
+			close(m.stop)
+			gone = append(gone, m)
+			continue
+		}
+		keep = append(keep, m)
+	}
+	secondaries = keep
+	secondaryMu.Unlock()
+	for _, m := range gone {
+		// a refresh already under way could still install the zone: wait
+		// for it, the ones after it see m.stop closed
+		m.refreshing.Lock()
+		m.tree.replaceZone(m.Zone, nil)
+		os.Remove(m.File)
+		m.refreshing.Unlock()
+		log.Printf("catalog %s: %s left the catalog", s.Zone, m.Zone)
+	}
+
+	var names []string
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sz := secondaryFor(s.tree, name); sz != nil && sz.Zone == name {
+			continue
+		}
+		if name == "." || isBelow(name, s.Zone) || strings.ContainsAny(name, `/\`) {
+			log.Printf("catalog %s: skipping member %q", s.Zone, name)
+			continue
+		}
+		if hasType(s.tree.get(name), type_soa) {
+			log.Printf("catalog %s: %s is a zone of ours already", s.Zone, name)
+			continue
+		}
+		m, err := newSecondary(secondaryZone{Zone: name, Primary: s.Primary, KeyName: s.KeyName, View: s.View,
+			File: filepath.Join(filepath.Dir(s.File), "zone."+strings.TrimSuffix(name, ".")+".txt"), member: s.Zone})
+		if err != nil {
+			log.Printf("catalog %s: %v", s.Zone, err)
+			continue
+		}
+		secondaryMu.Lock()
+		secondaries = append(secondaries, m)
+		running := secondariesRunning
+		secondaryMu.Unlock()
+		if running {
+			go m.run()
+		}
+		log.Printf("catalog %s: added %s", s.Zone, name)
+	}
+}
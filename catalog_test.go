@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatalogZone(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	primaryFile := filepath.Join(dir, "zone.primary.txt")
+	secondaryFile := filepath.Join(dir, "zone.secondary.txt")
+	os.WriteFile(primaryFile, []byte("example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600\n"+
+		"www.example.com. A 192.0.2.1 300\n"+
+		"example.net. SOA ns1.example.net. hostmaster.example.net. 1 3600 600 86400 300 3600\n"+
+		"www.example.net. A 192.0.2.2 300\n"), 0644)
+	os.WriteFile(secondaryFile, []byte("example.org. SOA ns1.example.org. hostmaster.example.org. 1 3600 600 86400 300 3600\n"), 0644)
+
+	setupAXFR([]string{"127.0.0.1"}, []tsigKey{{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256}})
+	err := setupViews(
+		view{Name: "primary", Match: []string{"127.0.0.1/32"}, File: primaryFile},
+		view{Name: "secondary", Match: []string{"127.0.0.2/32"}, File: secondaryFile},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle_tcp_conn(c)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		setupSecondaries()
+		setupCatalogs()
+		views = nil
+	})
+
+	// producer: a new catalog lists both zones
+	if err := setupCatalogs(catalogZone{Zone: "catalog.invalid", View: "primary"}); err != nil {
+		t.Fatal(err)
+	}
+	primary := findView("primary").zone
+	members, err := catalogMembers(primary, "catalog.invalid.")
+	if err != nil || len(members) != 2 || !members["example.com."] || !members["example.net."] {
+		t.Fatalf("catalog members %v: %v", members, err)
+	}
+	serial := func(z *zoneTree, apex string) uint32 {
+		soa, _ := z.soaLocked(apex)
+		return soa.SOA.Serial
+	}
+	if updateCatalogs(); serial(primary, "catalog.invalid.") != 1 {
+		t.Errorf("unchanged zones bumped the catalog serial to %d", serial(primary, "catalog.invalid."))
+	}
+
+	// consumer: the catalog's members become secondary zones
+	catFile := filepath.Join(dir, "zone.catalog.invalid.txt")
+	if err := setupSecondaries(secondaryZone{Zone: "catalog.invalid.", Primary: ln.Addr().String(), KeyName: "axfr-key.", File: catFile, View: "secondary", Catalog: true}); err != nil {
+		t.Fatal(err)
+	}
+	cat := secondaries[0]
+	now := time.Now()
+	cat.refresh(now)
+	zones := func() []string {
+		var out []string
+		for _, s := range secondaryStatus() {
+			if s.Catalog == "catalog.invalid." {
+				out = append(out, s.Zone)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	if got := zones(); len(got) != 2 || got[0] != "example.com." || got[1] != "example.net." {
+		t.Fatalf("members after the first transfer: %v (%s)", got, cat.err)
+	}
+	for _, s := range secondaries[1:] {
+		s.refresh(now)
+	}
+	query := func(name string) *dns_msg {
+		t.Helper()
+		msg, err := parse_full_msg(answer_msg(testQuery(name, type_a), net.ParseIP("127.0.0.2"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := query("www.example.net."); len(msg.Answer) != 1 || net.IP(msg.Answer[0].Rdata).String() != "192.0.2.2" {
+		t.Errorf("member not transferred: %+v", msg)
+	}
+	netFile := filepath.Join(dir, "zone.example.net.txt")
+	if _, err := os.Stat(netFile); err != nil {
+		t.Errorf("member not saved: %v", err)
+	}
+
+	// a zone added on the primary and one removed: one catalog change, by IXFR
+	primary.change("", nil, []rr{makeRR("example.org.", type_soa, 3600, findView("secondary").zone.get("example.org.")[0].Rdata)})
+	netRecords := primary.snapshot("example.net.")
+	primary.replaceZone("example.net.", nil)
+	if updateCatalogs(); serial(primary, "catalog.invalid.") != 2 {
+		t.Errorf("catalog serial %d after a change", serial(primary, "catalog.invalid."))
+	}
+	if data, _ := os.ReadFile(primaryFile); !strings.Contains(string(data), zoneLine(catalogMember("catalog.invalid.", "example.org."))) {
+		t.Errorf("catalog not saved:\n%s", data)
+	}
+	// a refresh of the leaving member that is still under way finishes
+	// before the member is removed
+	var member *secondaryZone
+	for _, s := range secondaries {
+		if s.Zone == "example.net." {
+			member = s
+		}
+	}
+	member.refreshing.Lock()
+	done := make(chan bool)
+	go func() {
+		cat.refresh(now)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	member.tree.replaceZone(member.Zone, netRecords) // what that refresh installs
+	member.refreshing.Unlock()
+	<-done
+	if _, ok := cat.tree.ixfrRecords("catalog.invalid.", 1); !ok {
+		t.Error("catalog change wasn't an IXFR")
+	}
+	// example.org. is a primary zone of the secondary's view already
+	if got := zones(); len(got) != 1 || got[0] != "example.com." {
+		t.Errorf("members after the change: %v", got)
+	}
+	if msg := query("www.example.net."); len(msg.Answer) != 0 {
+		t.Errorf("removed member still served: %+v", msg)
+	}
+	if _, err := os.Stat(netFile); !os.IsNotExist(err) {
+		t.Errorf("removed member's file: %v", err)
+	}
+	// and later refreshes don't bring it back, even from a primary that has it
+	primary.replaceZone("example.net.", netRecords)
+	member.refresh(now)
+	primary.replaceZone("example.net.", nil)
+	if msg := query("www.example.net."); len(msg.Answer) != 0 {
+		t.Errorf("removed member served after a refresh: %+v", msg)
+	}
+
+	// after a restart the saved catalog brings its members back
+	setupViews(
+		view{Name: "primary", Match: []string{"127.0.0.1/32"}, File: primaryFile},
+		view{Name: "secondary", Match: []string{"127.0.0.2/32"}, File: secondaryFile},
+	)
+	if err := setupSecondaries(secondaryZone{Zone: "catalog.invalid.", Primary: ln.Addr().String(), KeyName: "axfr-key.", File: catFile, View: "secondary", Catalog: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := zones(); len(got) != 1 || !secondaries[1].serving() {
+		t.Errorf("members from the saved catalog: %v", got)
+	}
+}
@@ -1,8 +1,23 @@
 package main
 
+import (
+	"log"
+	"strings"
+)
+
 // filterAnswers filters DNS records according to RFC CNAME rules - need to still understand the RFC
 // like why txxt and all records should also be like returned by the cname server
 func filterAnswers(qType uint16, answers []rr) []rr {
+	// ALIAS is only ours: expandAlias turns it into A/AAAA, it never goes out
+	// as is (not for ANY or a TYPE65401 query either)
+	var public []rr
+	for _, r := range answers {
+		if r.Type_ != type_alias {
+			public = append(public, r)
+		}
+	}
+	answers = public
+
 	var cnameAnswers []rr
 	for _, r := range answers {
 		if r.Type_ == 5 { // CNAME
@@ -32,5 +47,191 @@ func filterAnswers(qType uint16, answers []rr) []rr {
 	return filteredAnswers
 }
 
+// maximum number of CNAMEs followed inside our own data for one query
+const maxCNAMEChain = 8
+
+// what a QTYPE=ANY query over udp gets (RFC 8482). tcp always gets everything
+//
+//	"hinfo": a single synthesized HINFO record
+//	"rrset": one of the RRsets at the name
+//	"full":  every record at the name, the old behaviour
+var anyPolicy = "hinfo"
+
+// skip additional section processing, like bind's minimal-responses (edit as needed).
+// referrals still carry their glue
+var minimalResponses = false
+
+// queryResult is everything that goes into the response for one question
+type queryResult struct {
+	Rcode      uint16
+	Answer     []rr
+	Authority  []rr
+	Additional []rr
+	Referral   bool // not our data: AA is cleared
+	Truncated  bool // TC: did not fit, retry over tcp
+}
+
+// answerQuery builds the response sections for name/qType. when the name is a
+// CNAME and the target is also in one of our zones, the chain is followed
+// (RFC 1034 section 4.3.2 step 3a) and the final RRset is added after the CNAMEs.
+// out-of-zone and dangling targets just end the chain, the resolver takes it
+// from there; only a missing original QNAME gets NXDOMAIN
+func (z *zoneTree) answerQuery(name string, qType uint16) queryResult {
+	var res queryResult
+	seen := map[string]bool{}
+	for i := 0; ; i++ {
+		seen[name] = true
+		// below a zone cut (except DS at the cut itself, which the parent owns)
+		if cut := z.findZoneCut(name); cut != "" && !(name == cut && qType == type_ds) {
+			if i == 0 {
+				return z.referral(cut)
+			}
+			return res // the chain left our authoritative data
+		}
+		recs, exists := z.lookupName(name)
+		filtered := filterAnswers(qType, z.expandAlias(recs, qType))
+		if len(filtered) > 0 && (qType == type_a || qType == type_aaaa) && filtered[0].Type_ == qType {
+			filtered = z.orderAnswers(name, healthyAnswers(filtered))
+		}
+		// if the answer is from a wildcard, set the owner name to the query name
+		for _, r := range filtered {
+			r.Name = name
+			res.Answer = append(res.Answer, r)
+		}
+		if len(filtered) == 0 {
+			if !exists && i == 0 {
+				res.Rcode = rcode_nxdomain
+			}
+			res.Authority = z.negativeSOA(name)
+			return res
+		}
+		if qType == type_cname || qType == 255 || filtered[0].Type_ != type_cname {
+			return res
+		}
+		target := strings.ToLower(decode_name(filtered[0].Rdata))
+		switch {
+		case z.findZoneApex(target) == "":
+			return res // not ours, resolver will chase it
+		case seen[target]:
+			log.Printf("CNAME loop at %s -> %s", name, target)
+			return res
+		case i+1 >= maxCNAMEChain:
+			log.Printf("CNAME chain from %s is longer than %d", name, maxCNAMEChain)
+			return res
+		}
+		name = target
+	}
+}
+
+// referral points the client at the child zone's nameservers (RFC 1034
+// section 4.3.2 step 3b), with glue for nameservers inside the parent zone.
+// glue below the cut comes first since it is the part that must not be dropped
+func (z *zoneTree) referral(cut string) queryResult {
+	res := queryResult{Referral: true}
+	apex := z.findZoneApex(cut)
+	var sibling []rr
+	for _, r := range z.get(cut) {
+		if r.Type_ != type_ns {
+			continue
+		}
+		res.Authority = append(res.Authority, r)
+		target := strings.ToLower(decode_name(r.Rdata))
+		if target != apex && !strings.HasSuffix(target, "."+apex) && apex != "." {
+			continue // out of bailiwick, no glue
+		}
+		for _, g := range z.get(target) {
+			if g.Type_ != type_a && g.Type_ != type_aaaa {
+				continue
+			}
+			if isBelow(target, cut) {
+				res.Additional = append(res.Additional, g)
+			} else {
+				sibling = append(sibling, g)
+			}
+		}
+	}
+	res.Additional = append(res.Additional, sibling...)
+	return res
+}
+
+// isBelow reports whether name is at or below parent
+func isBelow(name, parent string) bool {
+	return name == parent || parent == "." || strings.HasSuffix(name, "."+parent)
+}
+
+// addAdditional puts the addresses of in-zone MX exchanges, NS hosts and SRV
+// targets from the answer into the additional section (RFC 1035 section 3.3.9,
+// RFC 2782), saving the client a round trip
+func (z *zoneTree) addAdditional(res *queryResult) {
+	seen := map[string]bool{}
+	for _, r := range res.Answer {
+		if r.Type_ == type_a || r.Type_ == type_aaaa {
+			seen[strings.ToLower(r.Name)] = true
+		}
+	}
+	for _, r := range res.Answer {
+		var target string
+		var err error
+		switch r.Type_ {
+		case type_mx:
+			target, _, err = readRdataName(r.Rdata, 2)
+		case type_ns:
+			target, _, err = readRdataName(r.Rdata, 0)
+		case type_srv:
+			target, _, err = readRdataName(r.Rdata, 6)
+		default:
+			continue
+		}
+		target = strings.ToLower(target)
+		if err != nil || target == "." || seen[target] || !z.isAuthoritative(target) {
+			continue
+		}
+		seen[target] = true
+		recs, _ := z.lookupName(target)
+		for _, a := range recs {
+			if a.Type_ == type_a || a.Type_ == type_aaaa {
+				a.Name = target
+				res.Additional = append(res.Additional, a)
+			}
+		}
+	}
+}
+
+// minimalANY cuts an ANY answer down according to anyPolicy so the server is
+// a poor amplifier. NODATA/NXDOMAIN answers are left alone
+func minimalANY(name string, answer []rr) []rr {
+	if len(answer) == 0 {
+		return answer
+	}
+	switch anyPolicy {
+	case "full":
+		return answer
+	case "rrset":
+		var out []rr
+		for _, r := range answer {
+			if r.Type_ == answer[0].Type_ {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	// RFC 8482 section 4.2: CPU "RFC8482", empty OS
+	rdata := append([]byte{7}, "RFC8482"...)
+	return []rr{{Name: name, Type_: type_hinfo, Class: class_in, TTL: 3789, Rdata: append(rdata, 0)}}
+}
+
+// negativeSOA is the authority section for NXDOMAIN/NODATA answers: the zone's
+// SOA with the negative caching ttl from RFC 2308 section 3
+func (z *zoneTree) negativeSOA(name string) []rr {
+	apex := z.findZoneApex(name)
+	for _, r := range z.get(apex) {
+		if r.Type_ == type_soa && r.SOA != nil {
+			r.TTL = min(r.TTL, r.SOA.Minimum)
+			return []rr{r}
+		}
+	}
+	return nil
+}
+
 //this entire codebase is just patch upon patch cause i am figuring out dns specs and as i do and understand just adding a patch
 // TODO: refactor this into proper functions
@@ -2,4 +2,4 @@ module dns-go
 
 go 1.24.5
 
-require golang.org/x/crypto v0.40.0 // indirect
+require golang.org/x/crypto v0.40.0
@@ -0,0 +1,267 @@
+// health checks for A/AAAA records: failing addresses are left out of answers
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheck is the check= option of a record, eg
+// "; check=tcp port=443 interval=10s" or "; check=http port=80 path=/health".
+// "check=cmd cmd=/usr/local/bin/probe" runs the command with the address and
+// owner name as arguments, exit status 0 means healthy
+type healthCheck struct {
+	Kind     string // tcp, http or cmd
+	Port     int
+	Path     string
+	Cmd      string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+)
+
+// healthState is what the last probe of one record found
+type healthState struct {
+	Healthy bool
+	Checked time.Time
+	Err     string
+	next    time.Time
+	running bool
+}
+
+// probe state by checkKey, only touched under healthMu
+var healthStates = map[string]*healthState{}
+var healthMu sync.Mutex
+
+// checkKey identifies the probe of a record; records with the same name,
+// address and check share it
+func checkKey(r rr) string {
+	return r.Name + " " + net.IP(r.Rdata).String() + " " + r.Check.String()
+}
+
+// String is the check in zone file option form
+func (c *healthCheck) String() string {
+	s := "check=" + c.Kind
+	if c.Port != 0 {
+		s += " port=" + strconv.Itoa(c.Port)
+	}
+	if c.Path != "" {
+		s += " path=" + c.Path
+	}
+	if c.Cmd != "" {
+		s += " cmd=" + c.Cmd
+	}
+	if c.Interval != defaultCheckInterval {
+		s += " interval=" + c.Interval.String()
+	}
+	if c.Timeout != defaultCheckTimeout {
+		s += " timeout=" + c.Timeout.String()
+	}
+	return s
+}
+
+// validate fills in defaults and checks the options make a usable probe
+func (c *healthCheck) validate() error {
+	if c.Interval == 0 {
+		c.Interval = defaultCheckInterval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultCheckTimeout
+	}
+	switch c.Kind {
+	case "tcp":
+		if c.Port == 0 {
+			return errors.New("check=tcp needs a port")
+		}
+	case "http":
+		if c.Port == 0 {
+			c.Port = 80
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+	case "cmd":
+		if c.Cmd == "" {
+			return errors.New("check=cmd needs cmd=")
+		}
+	default:
+		return fmt.Errorf("unknown check %q", c.Kind)
+	}
+	return nil
+}
+
+// probe runs the check once against addr
+func (c *healthCheck) probe(name string, addr net.IP) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	hostport := net.JoinHostPort(addr.String(), strconv.Itoa(c.Port))
+	switch c.Kind {
+	case "tcp":
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", hostport)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+hostport+c.Path, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = strings.TrimSuffix(name, ".")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	default:
+		return exec.CommandContext(ctx, c.Cmd, addr.String(), name).Run()
+	}
+}
+
+// startHealthChecks probes every checked record at its interval, forever
+func startHealthChecks() {
+	for {
+		checkDue(time.Now())
+		time.Sleep(time.Second)
+	}
+}
+
+// checkDue starts the probes that are due at now and drops the state of
+// records that are gone. the returned WaitGroup finishes with the probes
+func checkDue(now time.Time) *sync.WaitGroup {
+	wanted := map[string]rr{}
+	for _, v := range allViews() {
+		for _, name := range v.zone.names() {
+			for _, r := range v.zone.get(name) {
+				if r.Check != nil {
+					wanted[checkKey(r)] = r
+				}
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for key := range healthStates {
+		if _, ok := wanted[key]; !ok {
+			delete(healthStates, key)
+		}
+	}
+	for key, r := range wanted {
+		st := healthStates[key]
+		if st == nil {
+			st = &healthState{Healthy: true} // healthy until a probe says otherwise
+			healthStates[key] = st
+		}
+		if st.running || now.Before(st.next) {
+			continue
+		}
+		st.running = true
+		st.next = now.Add(r.Check.Interval)
+		wg.Add(1)
+		go func(st *healthState, r rr) {
+			defer wg.Done()
+			err := r.Check.probe(r.Name, net.IP(r.Rdata))
+			healthMu.Lock()
+			defer healthMu.Unlock()
+			if st.Healthy != (err == nil) {
+				log.Printf("health: %s %s is now %s (%v)", r.Name, net.IP(r.Rdata), healthWord(err == nil), err)
+			}
+			st.Healthy, st.Checked, st.running = err == nil, time.Now(), false
+			st.Err = ""
+			if err != nil {
+				st.Err = err.Error()
+			}
+		}(st, r)
+	}
+	return &wg
+}
+
+func healthWord(healthy bool) string {
+	if healthy {
+		return "up"
+	}
+	return "down"
+}
+
+// isHealthy reports the last probe result; unchecked records are always healthy
+func isHealthy(r rr) bool {
+	if r.Check == nil {
+		return true
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	st := healthStates[checkKey(r)]
+	return st == nil || st.Healthy
+}
+
+// healthyAnswers drops the addresses that failed their checks. backup records
+// are only served when no primary is healthy; if nothing is healthy at all
+// every record is served rather than answering with nothing
+func healthyAnswers(rrs []rr) []rr {
+	var primary, backup, allPrimary, allBackup []rr
+	for _, r := range rrs {
+		healthy := isHealthy(r)
+		switch {
+		case r.Backup:
+			allBackup = append(allBackup, r)
+			if healthy {
+				backup = append(backup, r)
+			}
+		default:
+			allPrimary = append(allPrimary, r)
+			if healthy {
+				primary = append(primary, r)
+			}
+		}
+	}
+	switch {
+	case len(primary) > 0:
+		return primary
+	case len(backup) > 0:
+		return backup
+	case len(allBackup) > 0:
+		return allBackup
+	}
+	return allPrimary
+}
+
+// healthStatus describes a record's health for the web ui
+func healthStatus(r rr) string {
+	if r.Check == nil {
+		if r.Backup {
+			return "backup"
+		}
+		return ""
+	}
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	s := "not checked yet"
+	if st := healthStates[checkKey(r)]; st != nil && !st.Checked.IsZero() {
+		s = healthWord(st.Healthy) + " at " + st.Checked.Format("15:04:05")
+		if st.Err != "" {
+			s += ": " + st.Err
+		}
+	}
+	if r.Backup {
+		s = "backup, " + s
+	}
+	return r.Check.String() + " - " + s
+}
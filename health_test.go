@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answerAddrs returns the sorted addresses answered for name
+func answerAddrs(name string) string {
+	var addrs []string
+	for _, r := range zone.answerQuery(name, type_a).Answer {
+		addrs = append(addrs, net.IP(r.Rdata).String())
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, " ")
+}
+
+func TestHealthChecks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.Host != "web.example.com" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+	httpPort := strconv.Itoa(web.Listener.Addr().(*net.TCPAddr).Port)
+	truePath, err1 := exec.LookPath("true")
+	falsePath, err2 := exec.LookPath("false")
+	if err1 != nil || err2 != nil {
+		t.Skip("no true/false commands")
+	}
+
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"tcp.example.com. A 127.0.0.1 60 ; check=tcp port="+tcpPort,
+		"tcp.example.com. A 127.0.0.2 60 ; check=tcp port="+tcpPort,
+		"tcp.example.com. A 192.0.2.99 60 ; backup",
+		"web.example.com. A 127.0.0.1 60 ; check=http port="+httpPort+" path=/health interval=30s",
+		"web.example.com. A 127.0.0.2 60 ; check=http port="+httpPort+" path=/health interval=30s",
+		"cmd.example.com. A 192.0.2.1 60 ; check=cmd cmd="+truePath,
+		"cmd.example.com. A 192.0.2.2 60 ; check=cmd cmd="+falsePath,
+		"bad.example.com. A 192.0.2.1 60 ; check=http port=1 path=/",
+		"bad.example.com. A 192.0.2.2 60 ; check=http port=1 path=/",
+	)
+	healthStates = map[string]*healthState{}
+
+	// nothing probed yet: everything counts as healthy, backups stay out
+	if got := answerAddrs("tcp.example.com."); got != "127.0.0.1 127.0.0.2" {
+		t.Errorf("before checks: %s", got)
+	}
+
+	now := time.Now()
+	checkDue(now).Wait()
+	for name, want := range map[string]string{
+		"tcp.example.com.": "127.0.0.1",
+		"web.example.com.": "127.0.0.1",
+		"cmd.example.com.": "192.0.2.1",
+	} {
+		if got := answerAddrs(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if s := healthStatus(zone.get("tcp.example.com.")[1]); !strings.Contains(s, "down") {
+		t.Errorf("web ui status %q", s)
+	}
+
+	// the last primary goes down: the backup takes over
+	ln.Close()
+	checkDue(now.Add(11 * time.Second)).Wait()
+	if got := answerAddrs("tcp.example.com."); got != "192.0.2.99" {
+		t.Errorf("all primaries down: %s", got)
+	}
+	// web has a 30s interval, it is not probed again yet
+	if got := answerAddrs("web.example.com."); got != "127.0.0.1" {
+		t.Errorf("web probed early: %s", got)
+	}
+
+	// everything down and no backup: serve them all rather than nothing
+	checkDue(now.Add(time.Minute)).Wait()
+	if got := answerAddrs("bad.example.com."); got != "192.0.2.1 192.0.2.2" {
+		t.Errorf("no healthy address and no backup: %s", got)
+	}
+
+	// state of removed records is dropped
+	zone.set("cmd.example.com.", nil)
+	checkDue(now.Add(2 * time.Minute)).Wait()
+	for key := range healthStates {
+		if strings.HasPrefix(key, "cmd.example.com.") {
+			t.Errorf("stale state for %s", key)
+		}
+	}
+}
+
+func TestHealthCheckOptions(t *testing.T) {
+	for _, opts := range []string{"check=tcp", "check=ping port=1", "check=cmd", "check=tcp port=x", "check=tcp port=80 interval=10ms"} {
+		r := makeRR("www.example.com.", type_a, 60, []byte{192, 0, 2, 1})
+		if err := applyRecordOptions(&r, opts); err == nil {
+			t.Errorf("%q accepted", opts)
+		}
+	}
+	r := makeRR("www.example.com.", type_txt, 60, []byte{1, 'x'})
+	if err := applyRecordOptions(&r, "check=tcp port=80"); err == nil {
+		t.Error("check on a TXT record accepted")
+	}
+	r = makeRR("www.example.com.", type_a, 60, []byte{192, 0, 2, 1})
+	if err := applyRecordOptions(&r, "check=http port=8080 interval=1m backup"); err != nil {
+		t.Fatal(err)
+	}
+	if got := recordOptions(r); got != " ; check=http port=8080 path=/ interval=1m0s backup" {
+		t.Errorf("options written as %q", got)
+	}
+}
+
+func TestWebAddRecord(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	analyticsSummaryFile = filepath.Join(dir, "analytics_summary.json")
+	file := filepath.Join(dir, "zone.txt")
+	os.WriteFile(file, []byte("example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600\n"), 0644)
+	if err := setupViews(view{Name: "default", Match: []string{"0.0.0.0/0"}, File: file}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { views = nil })
+	post := func(type_, value, options string) {
+		form := url.Values{"name": {"www.example.com"}, "type": {type_}, "value": {value}, "options": {options}, "ttl": {"300"}}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handle_index(httptest.NewRecorder(), req)
+	}
+
+	// check=cmd would run a program on the server, only the zone file may set it
+	for _, tc := range []struct {
+		ip, options string
+		added       bool
+	}{
+		{"192.0.2.1", "check=cmd cmd=/bin/true", false},
+		{"192.0.2.2", "check=tcp port=80 cmd=/bin/true", false},
+		{"192.0.2.3", "check=tcp port=80 interval=1m", true},
+	} {
+		post("A", tc.ip, tc.options)
+		found := false
+		for _, r := range findView("default").zone.get("www.example.com.") {
+			found = found || net.IP(r.Rdata).String() == tc.ip
+		}
+		if found != tc.added {
+			t.Errorf("%s %q: added %v", tc.ip, tc.options, found)
+		}
+	}
+
+	// a ';' in the value is part of it
+	post("TXT", "v=DKIM1; k=rsa; p=MIGfMA0", "")
+	found := false
+	for _, r := range findView("default").zone.get("www.example.com.") {
+		found = found || (r.Type_ == type_txt && formatRdata(type_txt, r.Rdata) == `"v=DKIM1; k=rsa; p=MIGfMA0"`)
+	}
+	if !found {
+		t.Errorf("TXT with ';' not added whole: %+v", findView("default").zone.get("www.example.com."))
+	}
+}
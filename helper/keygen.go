@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// the algorithms tsigMAC supports, with their key size: as long as the hash
+// output, like tsig-keygen does
+var keyAlgorithms = []struct {
+	name string
+	size int
+}{
+	{"hmac-md5", 16},
+	{"hmac-sha256", 32},
+	{"hmac-sha512", 64},
+}
+
+// keygen prints new random TSIG keys for the server's key file, in BIND
+// format or with -json in JSON. "all" makes one key per algorithm, named
+// <name>-<algorithm>
+func keygen(args []string) {
+	asJSON := len(args) > 0 && args[0] == "-json"
+	if asJSON {
+		args = args[1:]
+	}
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: go run . keygen [-json] <name> [algorithm|all]")
+		return
+	}
+	name := strings.TrimSuffix(args[0], ".")
+	alg := "hmac-sha256"
+	if len(args) == 2 {
+		alg = strings.ToLower(args[1])
+	}
+	type key struct {
+		Name      string `json:"name"`
+		Algorithm string `json:"algorithm"`
+		Secret    string `json:"secret"`
+	}
+	var keys []key
+	for _, a := range keyAlgorithms {
+		if alg != "all" && alg != a.name {
+			continue
+		}
+		secret := make([]byte, a.size)
+		if _, err := rand.Read(secret); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		k := key{Name: name + ".", Algorithm: a.name, Secret: base64.StdEncoding.EncodeToString(secret)}
+		if alg == "all" {
+			k.Name = name + "-" + a.name + "."
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "unknown algorithm", alg)
+		os.Exit(1)
+	}
+	if asJSON {
+		b, _ := json.MarshalIndent(keys, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	for _, k := range keys {
+		fmt.Printf("key \"%s\" {\n\talgorithm %s;\n\tsecret \"%s\";\n};\n", k.Name, k.Algorithm, k.Secret)
+	}
+}
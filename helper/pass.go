@@ -5,8 +5,13 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run pass.go <password>")
+		fmt.Println("Usage: go run . <password>")
+		fmt.Println("       go run . keygen [-json] <name> [algorithm|all]")
 		return
 	}
 	hash, _ := bcrypt.GenerateFromPassword([]byte(os.Args[1]), bcrypt.DefaultCost)
@@ -0,0 +1,177 @@
+// zone changes: applied in one step, with the SOA serial bumped and the
+// difference kept for IXFR
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// how many changes are kept per zone for IXFR; older clients get the whole zone
+var ixfrJournalSize = 100
+
+// zoneDelta is one change to a zone: the SOA before and after it, with the
+// records deleted and added in between (RFC 1995 section 4)
+type zoneDelta struct {
+	From, To rr
+	Deleted  []rr
+	Added    []rr
+}
+
+// serialLess compares SOA serials with RFC 1982 serial number arithmetic
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// withSerial returns a copy of an SOA record with a new serial
+func withSerial(soa rr, serial uint32) rr {
+	soa.Rdata = append([]byte(nil), soa.Rdata...)
+	binary.BigEndian.PutUint32(soa.Rdata[len(soa.Rdata)-20:], serial)
+	return makeRR(soa.Name, type_soa, soa.TTL, soa.Rdata)
+}
+
+// sameRecord compares records the way zone edits do: name, type and rdata
+func sameRecord(a, b rr) bool {
+	return a.Name == b.Name && a.Type_ == b.Type_ && bytes.Equal(a.Rdata, b.Rdata)
+}
+
+// soaLocked returns the SOA at apex
+func (z *zoneTree) soaLocked(apex string) (rr, bool) {
+	for _, r := range z.rrsLocked(apex) {
+		if r.Type_ == type_soa && r.SOA != nil {
+			return r, true
+		}
+	}
+	return rr{}, false
+}
+
+// change applies one edit to the zone at apex: del records are removed
+// (matched by name, type and rdata), add records are added unless they are
+// there already. readers see all of it or none of it. unless the edit is to
+// the SOA itself the serial goes up by one, and the difference is journaled.
+// apex "" is for names outside any zone, which just get edited
+func (z *zoneTree) change(apex string, del, add []rr) {
+	z.changeWith(apex, func() ([]rr, []rr, bool) { return del, add, true })
+}
+
+// changeWith is change for edits that depend on what is in the zone: edit
+// works out the records to delete and add while the lock is held, so nothing
+// changes in between (it may read with rrsLocked). when it returns false
+// nothing is changed. reports whether the edit went ahead
+func (z *zoneTree) changeWith(apex string, edit func() (del, add []rr, ok bool)) bool {
+	// secondaries are told about a new serial once the lock is released
+	var notifySerial *uint32
+	defer func() {
+		if notifySerial != nil {
+			notifyZone(apex, *notifySerial)
+		}
+	}()
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	del, add, ok := edit()
+	if !ok {
+		return false
+	}
+	oldSOA, hasSOA := z.soaLocked(apex)
+
+	var deleted, added []rr
+	touchesSOA := false
+	for _, d := range del {
+		var keep []rr
+		for _, r := range z.rrsLocked(d.Name) {
+			if sameRecord(r, d) {
+				deleted = append(deleted, r)
+				touchesSOA = touchesSOA || (r.Type_ == type_soa && r.Name == apex)
+			} else {
+				keep = append(keep, r)
+			}
+		}
+		z.setLocked(d.Name, keep)
+	}
+	for _, a := range add {
+		rrs := z.rrsLocked(a.Name)
+		dup := false
+		for _, r := range rrs {
+			dup = dup || sameRecord(r, a)
+		}
+		if dup {
+			continue
+		}
+		z.setLocked(a.Name, append(rrs[:len(rrs):len(rrs)], a))
+		added = append(added, a)
+		touchesSOA = touchesSOA || (a.Type_ == type_soa && a.Name == apex)
+	}
+	if !hasSOA || (len(deleted) == 0 && len(added) == 0) {
+		return true
+	}
+
+	newSOA, ok := z.soaLocked(apex)
+	if !touchesSOA {
+		newSOA, ok = withSerial(oldSOA, oldSOA.SOA.Serial+1), true
+		var rrs []rr
+		for _, r := range z.rrsLocked(apex) {
+			if r.Type_ == type_soa {
+				r = newSOA
+			}
+			rrs = append(rrs, r)
+		}
+		z.setLocked(apex, rrs)
+	}
+	if ok && newSOA.SOA.Serial != oldSOA.SOA.Serial {
+		notifySerial = &newSOA.SOA.Serial
+	}
+	if !ok || !serialLess(oldSOA.SOA.Serial, newSOA.SOA.Serial) {
+		// the SOA was removed or its serial didn't go up: the history no
+		// longer leads to the current version
+		delete(z.journal, apex)
+		return true
+	}
+	d := zoneDelta{From: oldSOA, To: newSOA}
+	for _, r := range deleted {
+		if r.Type_ != type_soa || r.Name != apex {
+			d.Deleted = append(d.Deleted, r)
+		}
+	}
+	for _, r := range added {
+		if r.Type_ != type_soa || r.Name != apex {
+			d.Added = append(d.Added, r)
+		}
+	}
+	j := append(z.journal[apex], d)
+	if len(j) > ixfrJournalSize {
+		j = j[len(j)-ixfrJournalSize:]
+	}
+	z.journal[apex] = j
+	return true
+}
+
+// ixfrRecords returns the IXFR answer for a client that has serial from: just
+// the current SOA when it is up to date, otherwise the current SOA, each
+// change since then as old SOA, deletions, new SOA, additions, and the
+// current SOA again. ok is false when the journal doesn't go back that far
+func (z *zoneTree) ixfrRecords(apex string, from uint32) ([]rr, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	cur, hasSOA := z.soaLocked(apex)
+	if !hasSOA {
+		return nil, false
+	}
+	if !serialLess(from, cur.SOA.Serial) {
+		return []rr{cur}, true
+	}
+	j := z.journal[apex]
+	for i, d := range j {
+		if d.From.SOA.Serial != from {
+			continue
+		}
+		out := []rr{cur}
+		for _, d := range j[i:] {
+			out = append(out, d.From)
+			out = append(out, d.Deleted...)
+			out = append(out, d.To)
+			out = append(out, d.Added...)
+		}
+		return append(out, cur), true
+	}
+	return nil, false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// types and serials of records, SOAs as their serial
+func describe(rrs []rr) []string {
+	var out []string
+	for _, r := range rrs {
+		if r.SOA != nil {
+			out = append(out, "SOA "+strconv.Itoa(int(r.SOA.Serial)))
+		} else {
+			out = append(out, r.Name+" "+formatRdata(r.Type_, r.Rdata))
+		}
+	}
+	return out
+}
+
+func TestZoneChangeJournal(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+	)
+	apex := "example.com."
+	mail := makeRR("mail.example.com.", type_a, 3600, net.ParseIP("192.0.2.25").To4())
+	www := makeRR("www.example.com.", type_a, 0, net.ParseIP("192.0.2.1").To4())
+
+	zone.change(apex, nil, []rr{mail})
+	zone.change(apex, []rr{www}, nil)
+	zone.change(apex, []rr{www}, []rr{mail}) // nothing to do, no new serial
+	if soa, _ := zone.soaLocked(apex); soa.SOA.Serial != 3 {
+		t.Fatalf("serial %d after two changes, want 3", soa.SOA.Serial)
+	}
+	if len(zone.get("www.example.com.")) != 0 || len(zone.get("mail.example.com.")) != 1 {
+		t.Errorf("changes not applied")
+	}
+
+	got, ok := zone.ixfrRecords(apex, 1)
+	want := []string{"SOA 3", "SOA 1", "SOA 2", "mail.example.com. 192.0.2.25", "SOA 2", "www.example.com. 192.0.2.1", "SOA 3", "SOA 3"}
+	if !ok || len(got) != len(want) {
+		t.Fatalf("ixfr from 1: %v %v", describe(got), ok)
+	}
+	for i, s := range describe(got) {
+		if s != want[i] {
+			t.Errorf("record %d is %q, want %q", i, s, want[i])
+		}
+	}
+	if got, ok := zone.ixfrRecords(apex, 3); !ok || len(got) != 1 {
+		t.Errorf("up to date client should get just the SOA: %v", describe(got))
+	}
+	if _, ok := zone.ixfrRecords(apex, 0); ok {
+		t.Error("serial 0 is older than the journal")
+	}
+
+	// a hand edit of the SOA that doesn't raise the serial loses the history
+	old, _ := zone.soaLocked(apex)
+	zone.change(apex, []rr{old}, []rr{withSerial(old, 2)})
+	if _, ok := zone.ixfrRecords(apex, 1); ok {
+		t.Error("journal kept across a serial that went backwards")
+	}
+
+	if !serialLess(0xffffffff, 0) || serialLess(0, 0xffffffff) {
+		t.Error("serials should wrap around (RFC 1982)")
+	}
+}
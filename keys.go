@@ -0,0 +1,292 @@
+// TSIG keys from a key file, in BIND or JSON format, reloaded when it changes
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// what a key may be used for, in tsigKey.Uses
+const (
+	keyUseTransfer = "transfer" // AXFR/IXFR, both as primary and as secondary
+	keyUseUpdate   = "update"   // dynamic updates
+	keyUseNotify   = "notify"   // sending and accepting NOTIFY
+)
+
+// guards axfrConf.TSIGKeys, which the key file replaces while serving
+var keysMu sync.RWMutex
+
+// the key file (see setupKeyFile), "" for none
+var keyFile string
+var keyFileMod time.Time
+
+// how often the key file is checked for changes
+var keyFileInterval = 5 * time.Second
+
+// algorithm names as written in key files, without the trailing dot
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":                 TSIG_HMAC_MD5,
+	"hmac-md5.sig-alg.reg.int": TSIG_HMAC_MD5,
+	"hmac-sha256":              TSIG_HMAC_SHA256,
+	"hmac-sha512":              TSIG_HMAC_SHA512,
+}
+
+// tsigKeys returns the keys in use
+func tsigKeys() []tsigKey {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return axfrConf.TSIGKeys
+}
+
+// keyAllows reports whether key may be used for use. a key without Uses may be
+// used for everything
+func keyAllows(key *tsigKey, use string) bool {
+	if len(key.Uses) == 0 {
+		return true
+	}
+	for _, u := range key.Uses {
+		if u == use {
+			return true
+		}
+	}
+	return false
+}
+
+// key file config (to call while dns startup, after setupAXFR). the keys in
+// the file replace the ones given to setupAXFR; watchKeyFile picks up changes
+func setupKeyFile(path string) error {
+	keyFile = path
+	keyFileMod = time.Time{}
+	return reloadKeyFile()
+}
+
+// watchKeyFile reloads the key file whenever it changes, forever. a file that
+// doesn't load keeps the keys from before
+func watchKeyFile() {
+	for {
+		time.Sleep(keyFileInterval)
+		if err := reloadKeyFile(); err != nil {
+			log.Printf("key file %s: %v", keyFile, err)
+		}
+	}
+}
+
+// reloadKeyFile loads the key file if it changed since the last load
+func reloadKeyFile() error {
+	if keyFile == "" {
+		return nil
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(keyFileMod) {
+		return nil
+	}
+	keys, err := loadKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+	keysMu.Lock()
+	axfrConf.TSIGKeys = keys
+	keysMu.Unlock()
+	keyFileMod = info.ModTime()
+	log.Printf("loaded %d TSIG keys from %s", len(keys), keyFile)
+	return nil
+}
+
+// loadKeyFile reads keys in JSON, a list of
+//
+//	{"name": "axfr-key.", "algorithm": "hmac-sha256", "secret": "...", "uses": ["transfer", "notify"]}
+//
+// or in the BIND format tsig-keygen writes, with an optional uses statement:
+//
+//	key "axfr-key." {
+//		algorithm hmac-sha256;
+//		secret "...";
+//		uses transfer notify;
+//	};
+func loadKeyFile(path string) ([]tsigKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []tsigKey
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		var raw []struct {
+			Name      string   `json:"name"`
+			Algorithm string   `json:"algorithm"`
+			Secret    string   `json:"secret"`
+			Uses      []string `json:"uses"`
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		for _, r := range raw {
+			keys = append(keys, tsigKey{Name: r.Name, Algorithm: r.Algorithm, Secret: r.Secret, Uses: r.Uses})
+		}
+	} else if keys, err = parseBINDKeys(string(data)); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i := range keys {
+		if err := validateKey(&keys[i]); err != nil {
+			return nil, err
+		}
+		if seen[keys[i].Name] {
+			return nil, fmt.Errorf("key %s is in the file twice", keys[i].Name)
+		}
+		seen[keys[i].Name] = true
+	}
+	return keys, nil
+}
+
+// validateKey normalizes a key from a key file and checks it can be used
+func validateKey(k *tsigKey) error {
+	if k.Name == "" {
+		return errors.New("key without a name")
+	}
+	k.Name = fqdn(strings.ToLower(k.Name))
+	alg, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(k.Algorithm), ".")]
+	if !ok {
+		return fmt.Errorf("key %s: unsupported algorithm %q", k.Name, k.Algorithm)
+	}
+	k.Algorithm = alg
+	if secret, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || len(secret) == 0 {
+		return fmt.Errorf("key %s: secret is not base64", k.Name)
+	}
+	for _, u := range k.Uses {
+		switch u {
+		case keyUseTransfer, keyUseUpdate, keyUseNotify:
+		default:
+			return fmt.Errorf("key %s: unknown use %q", k.Name, u)
+		}
+	}
+	return nil
+}
+
+// parseBINDKeys parses key { } statements. comments (#, //, /* */) are
+// skipped, other statements are an error
+func parseBINDKeys(data string) ([]tsigKey, error) {
+	toks, err := bindTokens(data)
+	if err != nil {
+		return nil, err
+	}
+	next := func() string {
+		if len(toks) == 0 {
+			return ""
+		}
+		t := toks[0]
+		toks = toks[1:]
+		return t
+	}
+	var keys []tsigKey
+	for len(toks) > 0 {
+		if t := next(); t != "key" {
+			return nil, fmt.Errorf("expected key, got %q", t)
+		}
+		k := tsigKey{Name: next()}
+		if next() != "{" {
+			return nil, fmt.Errorf("key %s: expected {", k.Name)
+		}
+		for {
+			t := next()
+			if t == "}" {
+				break
+			}
+			var args []string
+			for a := next(); a != ";"; a = next() {
+				if a == "" || a == "{" || a == "}" {
+					return nil, fmt.Errorf("key %s: %s not ended with ;", k.Name, t)
+				}
+				args = append(args, a)
+			}
+			switch {
+			case t == "algorithm" && len(args) == 1:
+				k.Algorithm = args[0]
+			case t == "secret" && len(args) == 1:
+				k.Secret = args[0]
+			case t == "uses" && len(args) > 0:
+				k.Uses = args
+			default:
+				return nil, fmt.Errorf("key %s: bad statement %q", k.Name, t)
+			}
+		}
+		if next() != ";" {
+			return nil, fmt.Errorf("key %s: expected ; after }", k.Name)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// bindTokens splits BIND config into words, quoted strings (without their
+// quotes) and the punctuation { } ;
+func bindTokens(data string) ([]string, error) {
+	var toks []string
+	r := bufio.NewReader(strings.NewReader(data))
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return toks, nil
+		}
+		switch {
+		case unicode.IsSpace(c):
+		case c == '#' || (c == '/' && peekRune(r) == '/'):
+			r.ReadString('\n')
+		case c == '/' && peekRune(r) == '*':
+			r.ReadRune()
+			for prev := ' '; ; {
+				c, _, err := r.ReadRune()
+				if err != nil {
+					return nil, errors.New("unterminated comment")
+				}
+				if prev == '*' && c == '/' {
+					break
+				}
+				prev = c
+			}
+		case c == '{' || c == '}' || c == ';':
+			toks = append(toks, string(c))
+		case c == '"':
+			s, err := r.ReadString('"')
+			if err != nil {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, strings.TrimSuffix(s, `"`))
+		default:
+			word := []rune{c}
+			for {
+				c, _, err := r.ReadRune()
+				if err != nil {
+					break
+				}
+				if unicode.IsSpace(c) || strings.ContainsRune(`{};"`, c) {
+					r.UnreadRune()
+					break
+				}
+				word = append(word, c)
+			}
+			toks = append(toks, string(word))
+		}
+	}
+}
+
+// peekRune returns the next rune without consuming it
+func peekRune(r *bufio.Reader) rune {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return 0
+	}
+	r.UnreadRune()
+	return c
+}
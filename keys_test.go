@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	path := filepath.Join(dir, "tsig.keys")
+	os.WriteFile(path, []byte(`# made with tsig-keygen
+key "axfr-key." {
+	algorithm hmac-sha256;
+	secret "dGVzdGtleQ==";
+	uses transfer notify;
+};
+/* no uses: good for everything */
+key "Other-Key" { algorithm HMAC-SHA512; secret "b3RoZXJrZXk="; }; // trailing comment
+`), 0644)
+	setupAXFR([]string{"127.0.0.1"}, nil)
+	t.Cleanup(func() {
+		keyFile = ""
+		setupAXFR(nil, nil)
+	})
+	if err := setupKeyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	k := getTSIGKey("axfr-key.")
+	if k == nil || k.Algorithm != TSIG_HMAC_SHA256 || k.Secret != "dGVzdGtleQ==" || !keyAllows(k, keyUseNotify) || keyAllows(k, keyUseUpdate) {
+		t.Errorf("axfr-key: %+v", k)
+	}
+	if k := getTSIGKey("other-key."); k == nil || k.Algorithm != TSIG_HMAC_SHA512 || !keyAllows(k, keyUseUpdate) {
+		t.Errorf("other-key: %+v", k)
+	}
+
+	// hot reload, to JSON; a key only for updates can't transfer
+	os.WriteFile(path, []byte(`[{"name": "axfr-key", "algorithm": "hmac-sha256", "secret": "dGVzdGtleQ==", "uses": ["update"]}]`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := reloadKeyFile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tsigKeys()) != 1 || getTSIGKey("other-key.") != nil {
+		t.Errorf("after reload: %+v", tsigKeys())
+	}
+	testZone(t, "example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600")
+	msgs := runAXFR(t, signedAXFR("example.com.", "axfr-key.", []byte("testkey"), time.Now(), 32))
+	if len(msgs) != 1 || msgs[0].Hdr.Flags&rcode_mask != rcode_refused {
+		t.Errorf("transfer with an update key: %+v", msgs)
+	}
+
+	// a broken file keeps the keys from before
+	os.WriteFile(path, []byte(`key "axfr-key." { algorithm hmac-sha1; secret "dGVzdGtleQ=="; };`), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err := reloadKeyFile(); err == nil || getTSIGKey("axfr-key.") == nil {
+		t.Errorf("bad algorithm: %v", err)
+	}
+	for _, bad := range []string{
+		`key "k." { algorithm hmac-sha256; secret "not base64!"; };`,
+		`key "k." { algorithm hmac-sha256; secret "dGVzdGtleQ=="; uses axfr; };`,
+		`key "k." { algorithm hmac-sha256 secret "dGVzdGtleQ=="; };`,
+		`key "k." { algorithm hmac-sha256; secret "dGVzdGtleQ=="; }`,
+		`options { };`,
+		`[{"name": "k.", "algorithm": "hmac-sha256", "secret": "dGVzdGtleQ=="}, {"name": "K", "algorithm": "hmac-sha256", "secret": "dGVzdGtleQ=="}]`,
+	} {
+		os.WriteFile(path, []byte(bad), 0644)
+		if _, err := loadKeyFile(path); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// LOC records (RFC 1876)
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	locEquator  = 1 << 31    // latitude/longitude of 0 degrees, in thousandths of an arc second
+	locAltBase  = 10000000   // altitude 0m, in cm (the reference is 100000m below the WGS 84 spheroid)
+	locMaxSize  = 9000000000 // 90000000.00m in cm
+	locDefSize  = 100        // 1m
+	locDefHoriz = 1000000    // 10000m
+	locDefVert  = 1000       // 10m
+)
+
+// parseLOC parses
+// d1 [m1 [s1]] {N|S} d2 [m2 [s2]] {E|W} alt[m] [siz[m] [hp[m] [vp[m]]]]
+func parseLOC(fields []string) ([]byte, error) {
+	lat, rest, err := parseLOCCoord(fields, "N", "S", 90)
+	if err != nil {
+		return nil, err
+	}
+	lon, rest, err := parseLOCCoord(rest, "E", "W", 180)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) == 0 || len(rest) > 4 {
+		return nil, errors.New("loc needs an altitude and at most size, horizontal and vertical precision")
+	}
+	alt, err := parseFixed(strings.TrimSuffix(strings.ToLower(rest[0]), "m"), 2)
+	if err != nil {
+		return nil, fmt.Errorf("bad loc altitude %q", rest[0])
+	}
+	if alt+locAltBase < 0 || alt+locAltBase > math.MaxUint32 {
+		return nil, fmt.Errorf("loc altitude %q out of range", rest[0])
+	}
+	sizes := []int64{locDefSize, locDefHoriz, locDefVert}
+	for i, f := range rest[1:] {
+		v, err := parseFixed(strings.TrimSuffix(strings.ToLower(f), "m"), 2)
+		if err != nil || v < 0 || v > locMaxSize {
+			return nil, fmt.Errorf("bad loc size/precision %q", f)
+		}
+		sizes[i] = v
+	}
+
+	out := []byte{0} // version
+	for _, v := range sizes {
+		out = append(out, locPrecision(v))
+	}
+	out = binary.BigEndian.AppendUint32(out, uint32(lat))
+	out = binary.BigEndian.AppendUint32(out, uint32(lon))
+	out = binary.BigEndian.AppendUint32(out, uint32(alt+locAltBase))
+	return out, nil
+}
+
+// parseLOCCoord reads "d [m [s]] hemisphere" and returns the wire value and the remaining fields
+func parseLOCCoord(fields []string, pos, neg string, maxDeg int64) (int64, []string, error) {
+	var nums []string
+	for i, f := range fields {
+		h := strings.ToUpper(f)
+		if h != pos && h != neg {
+			nums = append(nums, f)
+			if len(nums) > 3 {
+				break
+			}
+			continue
+		}
+		if len(nums) == 0 {
+			break
+		}
+		deg, err := strconv.ParseInt(nums[0], 10, 64)
+		if err != nil || deg < 0 || deg > maxDeg {
+			return 0, nil, fmt.Errorf("bad loc degrees %q", nums[0])
+		}
+		var min, sec int64
+		if len(nums) > 1 {
+			min, err = strconv.ParseInt(nums[1], 10, 64)
+			if err != nil || min < 0 || min > 59 {
+				return 0, nil, fmt.Errorf("bad loc minutes %q", nums[1])
+			}
+		}
+		if len(nums) > 2 {
+			sec, err = parseFixed(nums[2], 3)
+			if err != nil || sec < 0 || sec >= 60000 {
+				return 0, nil, fmt.Errorf("bad loc seconds %q", nums[2])
+			}
+		}
+		v := (deg*3600+min*60)*1000 + sec
+		if v > maxDeg*3600*1000 {
+			return 0, nil, errors.New("loc coordinate out of range")
+		}
+		if h == neg {
+			v = -v
+		}
+		return locEquator + v, fields[i+1:], nil
+	}
+	return 0, nil, fmt.Errorf("loc coordinate needs degrees and %s or %s", pos, neg)
+}
+
+// parseFixed parses a decimal number into an integer scaled by 10^decimals
+func parseFixed(s string, decimals int) (int64, error) {
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > decimals {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	frac += strings.Repeat("0", decimals-len(frac))
+	v, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+// locPrecision encodes a size in cm as mantissa (high nibble) * 10^exponent (low nibble)
+func locPrecision(cm int64) byte {
+	exp := 0
+	for cm >= 10 && exp < 9 {
+		cm /= 10
+		exp++
+	}
+	return byte(cm<<4) | byte(exp)
+}
+
+// formatLOC writes loc rdata back in the RFC 1876 presentation format
+func formatLOC(rdata []byte) (string, error) {
+	if len(rdata) != 16 || rdata[0] != 0 {
+		return "", errors.New("unsupported loc rdata")
+	}
+	var sizes []string
+	for _, p := range rdata[1:4] {
+		mant, exp := int64(p>>4), int(p&0x0f)
+		if mant > 9 || exp > 9 {
+			return "", errors.New("bad loc precision")
+		}
+		cm := mant
+		for i := 0; i < exp; i++ {
+			cm *= 10
+		}
+		sizes = append(sizes, formatFixed(cm, 2)+"m")
+	}
+	lat, err := formatLOCCoord(int64(binary.BigEndian.Uint32(rdata[4:])), "N", "S", 90)
+	if err != nil {
+		return "", err
+	}
+	lon, err := formatLOCCoord(int64(binary.BigEndian.Uint32(rdata[8:])), "E", "W", 180)
+	if err != nil {
+		return "", err
+	}
+	alt := formatFixed(int64(binary.BigEndian.Uint32(rdata[12:]))-locAltBase, 2) + "m"
+	return lat + " " + lon + " " + alt + " " + strings.Join(sizes, " "), nil
+}
+
+func formatLOCCoord(v int64, pos, neg string, maxDeg int64) (string, error) {
+	v -= locEquator
+	h := pos
+	if v < 0 {
+		v, h = -v, neg
+	}
+	if v > maxDeg*3600*1000 {
+		return "", errors.New("loc coordinate out of range")
+	}
+	deg := v / 3600000
+	min := v / 60000 % 60
+	sec := v % 60000
+	return strconv.FormatInt(deg, 10) + " " + strconv.FormatInt(min, 10) + " " + formatFixed(sec, 3) + " " + h, nil
+}
+
+// formatFixed is the reverse of parseFixed
+func formatFixed(v int64, decimals int) string {
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	s := strconv.FormatInt(v, 10)
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	return sign + s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+}
@@ -5,7 +5,9 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // import dnsfilter.go for filterAnswers
@@ -13,20 +15,67 @@ import (
 var port int16 = 8053
 
 func main() {
-	// Example: configure allowed secondaries and TSIG keys (edit as needed)
+	// Example: configure allowed secondaries (edit as needed)
 	setupAXFR(
 		[]string{"127.0.0.1"}, // allowed secondary IPs
-		[]tsigKey{{
-			Name:      "axfr-key.",
-			Secret:    "dGVzdGtleQ==", // base64 for 'testkey'
-			Algorithm: TSIG_HMAC_SHA256,
-		}},
+		nil,
 	)
+	// TSIG keys, BIND or JSON format (see keys.go), make them with
+	// "go run ./helper keygen <name>". changes are picked up while running
+	if err := setupKeyFile("tsig.keys"); err != nil {
+		log.Println("could not load TSIG keys: ", err)
+	}
+	go watchKeyFile()
+	// per-zone transfer ACLs (edit as needed), zones without one use the
+	// secondaries above
+	// err := setupXFRACLs(
+	// 	xfrACL{Zone: "example.com.", Rules: []string{"!192.0.2.66", "192.0.2.0/24 key axfr-key.", "2001:db8::/32 key axfr-key."}},
+	// )
+	// if err != nil {
+	// 	log.Println("bad transfer ACLs: ", err)
+	// }
+	// what each TSIG key may change with dynamic updates (edit as needed),
+	// keys without a policy can't update
+	// err := setupUpdatePolicy(
+	// 	updatePolicy{Key: "dhcp-key.", Names: []string{"*.dhcp.example.com."}, Types: []string{"A", "AAAA", "TXT"}},
+	// 	updatePolicy{Key: "acme-key.", Names: []string{"*.example.com."}, Types: []string{"TXT"}},
+	// )
+	// if err != nil {
+	// 	log.Println("bad update policy: ", err)
+	// }
+	// tell secondaries about changes right away (edit as needed), "" for unsigned
+	// setupNotify([]string{"192.0.2.54:53"}, "axfr-key.")
+	// split-horizon views (edit as needed), without them everyone gets zone.txt
+	// err := setupViews(
+	// 	view{Name: "internal", Match: []string{"10.0.0.0/8", "127.0.0.0/8"}, File: "zone.internal.txt"},
+	// 	view{Name: "external", Match: []string{"0.0.0.0/0", "::/0"}, File: "zone.txt"},
+	// )
+	// if err != nil {
+	// 	log.Println("bad views config: ", err)
+	// }
+
 	// load zone file
-	err := load_zone("zone.txt")
+	err := load_zone(zone, "zone.txt")
 	if err != nil {
 		log.Println("could not load zone: ", err)
 	}
+	// zones this server is a secondary for (edit as needed), transferred from
+	// their primary and saved to their own file
+	// err = setupSecondaries(
+	// 	secondaryZone{Zone: "example.org.", Primary: "192.0.2.53", KeyName: "axfr-key.", File: "zone.example.org.txt"},
+	// 	secondaryZone{Zone: "catalog.example.org.", Primary: "192.0.2.53", KeyName: "axfr-key.", File: "zone.catalog.example.org.txt", Catalog: true},
+	// )
+	// if err != nil {
+	// 	log.Println("bad secondaries config: ", err)
+	// }
+	go startSecondaries()
+	// catalog zone listing our zones (edit as needed), for secondaries that
+	// set Catalog on it
+	// err = setupCatalogs(catalogZone{Zone: "catalog.invalid."})
+	// if err != nil {
+	// 	log.Println("bad catalogs config: ", err)
+	// }
+	// go startCatalogs()
 
 	// start dns server (udp 53)
 	go start_dns(port)
@@ -34,6 +83,9 @@ func main() {
 	// start tcp dns server (AXFR/TSIG)
 	go start_tcp_dns(port)
 
+	// probe health-checked records
+	go startHealthChecks()
+
 	// start web ui (8080)
 	start_web()
 }
@@ -54,66 +106,59 @@ func start_dns(port int16) {
 			log.Println("error reading UDP: ", err)
 			continue
 		}
+		// copy out of buf, the next read reuses it while this query is answered
+		data := append([]byte(nil), buf[:n]...)
 		go func() {
 			defer func() {
 				if r := recover(); r != nil {
 					log.Println("Recovered from panic in handle_query:", r)
 				}
 			}()
-			handle_query(conn, client, buf[:n])
+			handle_query(conn, client, data)
 		}()
 	}
 }
 
 // findZoneRecords returns records for exact or wildcard matches
-func findZoneRecords(name string) []rr {
-	if recs, ok := zone[name]; ok && len(recs) > 0 {
-		return recs
-	}
-	// Try wildcard matches
-	labels := strings.Split(name, ".")
-	// Remove trailing empty label from split (from trailing dot)
-	if len(labels) > 0 && labels[len(labels)-1] == "" {
-		labels = labels[:len(labels)-1]
-	}
-	for i := 0; i < len(labels)-1; i++ {
-		wildcardLabels := make([]string, len(labels))
-		copy(wildcardLabels, labels)
-		wildcardLabels[i] = "*"
-		wildcardName := strings.Join(wildcardLabels, ".") + "."
-		if recs, ok := zone[wildcardName]; ok && len(recs) > 0 {
-			return recs
+func (z *zoneTree) findZoneRecords(name string) []rr {
+	recs, _ := z.lookupName(name)
+	return recs
+}
+
+// lookupName finds the records at name, synthesizing them from a wildcard the
+// way RFC 4592 section 3.3 describes: only when the name does not exist, and
+// only from the "*" directly below the closest encloser. exists is false when
+// the answer should be NXDOMAIN; an existing name without records (empty
+// non-terminal, or an empty wildcard match) gives exists with no records
+func (z *zoneTree) lookupName(name string) (recs []rr, exists bool) {
+	name = fqdn(strings.ToLower(name))
+	if z.exists(name) {
+		return z.get(name), true
+	}
+	// walk up to the closest encloser, the nearest ancestor that exists
+	encloser := name
+	for encloser != "." {
+		encloser = parentName(encloser)
+		if z.exists(encloser) {
+			break
 		}
 	}
-	return nil
+	source := "*." + encloser
+	if encloser == "." {
+		source = "*."
+	}
+	if !z.exists(source) {
+		return nil, false
+	}
+	return z.get(source), true
 }
 
 // typeToString mapping DNS type codes to their string names
 func typeToString(t uint16) string {
-	switch t {
-	case 1:
-		return "A"
-	case 2:
-		return "NS"
-	case 5:
-		return "CNAME"
-	case 6:
-		return "SOA"
-	case 12:
-		return "PTR"
-	case 15:
-		return "MX"
-	case 16:
-		return "TXT"
-	case 28:
-		return "AAAA"
-	case 33:
-		return "SRV"
-	case 255:
-		return "ANY"
-	default:
-		return "UNKNOWN"
+	if name, ok := typeNames[t]; ok {
+		return name
 	}
+	return "TYPE" + strconv.Itoa(int(t))
 }
 
 // classToString mapping DNS class codes to their string names
@@ -133,46 +178,104 @@ func classToString(c uint16) string {
 }
 
 func handle_query(conn *net.UDPConn, client *net.UDPAddr, data []byte) {
+	resp := answer_msg(data, client.IP, false)
+	if resp != nil {
+		conn.WriteToUDP(resp, client)
+	}
+}
+
+// answer_msg answers one query message from client, received over udp or tcp,
+// out of the client's view. udp responses are kept within 512 bytes. nil means
+// no response should be sent
+func answer_msg(data []byte, client net.IP, tcp bool) []byte {
+	maxSize := 512
+	if tcp {
+		maxSize = 65535
+	}
 	hdr, q, err := parse_dns_msg(data)
 	data_str := q.Name + " " + typeToString(q.Type_) + " " + classToString(q.Class)
 	if err != nil {
 		logAnalyticsEvent("error", data_str)
-		return
+		return nil
 	}
 
 	logAnalyticsEvent("request", data_str)
 
 	if q.Class != class_in {
 		logAnalyticsEvent("error", data_str)
-		return
+		return nil
+	}
+	switch (hdr.Flags & opcode_mask) >> 11 {
+	case opcode_notify:
+		return answerNotify(data, hdr, q, client)
+	case opcode_update:
+		return answerUpdate(data, client)
+	}
+	if q.Type_ == 251 && !tcp { // IXFR, over tcp it goes to handleAXFR
+		return answerIXFR(data, client)
 	}
 	name := strings.ToLower(q.Name)
 	if !strings.HasSuffix(name, ".") {
 		name += "."
 	}
-	answers := findZoneRecords(name)
-	if len(answers) == 0 {
+	// a signed query picks its view by key and gets a signed answer (RFC 8945
+	// section 5.3)
+	tsig, key, tsigErr, err := verifyTSIG(data, time.Now())
+	switch {
+	case err != nil:
+		logAnalyticsEvent("error", data_str)
+		resp, _ := build_message(hdr, q, queryResult{Rcode: rcode_formerr})
+		return resp
+	case tsigErr != 0:
+		log.Printf("query: TSIG error %d from %s (key %s)", tsigErr, client, tsig.Name)
+		resp, _ := tsigErrorResponse(hdr, q, tsig, key, tsigErr, time.Now())
+		return resp
+	}
+	signer := newTSIGStream(key, tsig)
+	keyName := ""
+	if key != nil {
+		keyName = key.Name
+		maxSize -= tsigReserve
+	}
+	v := viewFor(client, keyName)
+	if v == nil {
+		logAnalyticsEvent("error", data_str)
+		resp, _ := build_message(hdr, q, queryResult{Rcode: rcode_refused})
+		resp, _ = signer.sign(resp, time.Now())
+		return resp
+	}
+	z := v.zone
+	if s := secondaryFor(z, name); s != nil && !s.serving() {
+		// not transferred yet, or expired
+		resp, _ := build_message(hdr, q, queryResult{Rcode: rcode_servfail})
+		resp, _ = signer.sign(resp, time.Now())
+		return resp
+	}
+	res := z.answerQuery(name, q.Type_)
+	if res.Rcode == rcode_nxdomain {
 		logAnalyticsEvent("notfound", data_str)
 	}
-
-	// Refactored: use filterAnswers from dnsfilter.go
-	filteredAnswers := filterAnswers(q.Type_, answers)
-
-	// if the answer is from a wildcard, set the owner name to the query name
-	var fixedAnswers []rr
-	for _, r := range filteredAnswers {
-		if r.Name != name {
-			r2 := r
-			r2.Name = name
-			fixedAnswers = append(fixedAnswers, r2)
-		} else {
-			fixedAnswers = append(fixedAnswers, r)
+	if q.Type_ == 255 && !tcp {
+		res.Answer = minimalANY(name, res.Answer)
+	}
+	// lookups are case-insensitive, but owner names go back in the case the
+	// client used, resolvers doing 0x20 randomization check for it
+	for i := range res.Answer {
+		if res.Answer[i].Name == name {
+			res.Answer[i].Name = fqdn(q.Name)
 		}
 	}
-	resp, err := build_response(hdr, q, fixedAnswers, nil)
+	if !minimalResponses {
+		z.addAdditional(&res)
+	}
+
+	resp, err := fit_message(hdr, q, res, maxSize)
+	if err == nil {
+		resp, err = signer.sign(resp, time.Now())
+	}
 	if err != nil {
 		logAnalyticsEvent("error", data_str)
-		return
+		return nil
 	}
-	conn.WriteToUDP(resp, client)
+	return resp
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -11,7 +13,7 @@ import (
 
 func TestFindZoneRecords(t *testing.T) {
 	// Setup a test zone
-	zone = map[string][]rr{
+	zone = zoneFromMap(map[string][]rr{
 		"example.com.": {
 			{Name: "example.com.", Type_: type_a, Rdata: net.ParseIP("1.2.3.4").To4(), TTL: 123},
 			{Name: "example.com.", Type_: type_mx, Rdata: []byte{0, 10, 3, 'm', 'a', 'i', 'l', 0}, TTL: 234},
@@ -34,7 +36,7 @@ func TestFindZoneRecords(t *testing.T) {
 		"soa.example.com.": {
 			{Name: "soa.example.com.", Type_: type_soa, Rdata: soaToRdata(&soaRdata{MName: "ns1.example.com.", RName: "hostmaster.example.com.", Serial: 2023010101, Refresh: 3600, Retry: 1800, Expire: 604800, Minimum: 600}), TTL: 890},
 		},
-	}
+	})
 
 	testCases := []struct {
 		name         string
@@ -103,7 +105,7 @@ func TestFindZoneRecords(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			answers := findZoneRecords(tc.query)
+			answers := zone.findZoneRecords(tc.query)
 
 			if tc.expectedType == 0 {
 				if len(answers) != 0 {
@@ -172,3 +174,454 @@ func soaToRdata(soa *soaRdata) []byte {
 	binary.Write(buf, binary.BigEndian, soa.Minimum)
 	return buf.Bytes()
 }
+
+// testZone loads zone file lines into the global zone for a test
+func testZone(t *testing.T, lines ...string) {
+	t.Helper()
+	zone = newZoneTree()
+	for _, line := range lines {
+		line, options := splitComment(line)
+		r, err := parseRecord(line)
+		if err == nil {
+			err = applyRecordOptions(&r, options)
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		zone.add(r)
+	}
+}
+
+func TestResolveAnswersCNAMEChain(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. CNAME web.example.com. 300",
+		"web.example.com. CNAME host.example.org. 300",
+		"example.org. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"host.example.org. A 192.0.2.1 300",
+		"host.example.org. A 192.0.2.2 300",
+		"loop1.example.com. CNAME loop2.example.com. 300",
+		"loop2.example.com. CNAME loop1.example.com. 300",
+		"ext.example.com. CNAME cdn.example.net. 300",
+		"dangling.example.com. CNAME missing.example.com. 300",
+		"*.wild.example.com. CNAME host.example.org. 300",
+	)
+	names := func(answers []rr) []string {
+		var out []string
+		for _, r := range answers {
+			out = append(out, r.Name+" "+typeToString(r.Type_))
+		}
+		return out
+	}
+	cases := []struct {
+		qname string
+		qtype uint16
+		want  []string
+	}{
+		{"www.example.com.", type_a, []string{"www.example.com. CNAME", "web.example.com. CNAME", "host.example.org. A", "host.example.org. A"}},
+		{"www.example.com.", type_cname, []string{"www.example.com. CNAME"}},
+		{"www.example.com.", type_aaaa, []string{"www.example.com. CNAME", "web.example.com. CNAME"}},
+		{"loop1.example.com.", type_a, []string{"loop1.example.com. CNAME", "loop2.example.com. CNAME"}},
+		{"ext.example.com.", type_a, []string{"ext.example.com. CNAME"}},
+		{"dangling.example.com.", type_a, []string{"dangling.example.com. CNAME"}},
+		{"x.wild.example.com.", type_a, []string{"x.wild.example.com. CNAME", "host.example.org. A", "host.example.org. A"}},
+	}
+	for _, c := range cases {
+		got := names(zone.answerQuery(c.qname, c.qtype).Answer)
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s %s: got %v, want %v", c.qname, typeToString(c.qtype), got, c.want)
+		}
+	}
+}
+
+// RFC 4592 section 2.2.1 example zone and the queries from sections 2.2.1 and 2.2.2
+func TestWildcardRFC4592(t *testing.T) {
+	testZone(t,
+		"example. SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"example. NS ns.example.com. 3600",
+		"example. NS ns.example.net. 3600",
+		`*.example. TXT "this is a wildcard" 3600`,
+		"*.example. MX 10 host1.example. 3600",
+		`sub.*.example. TXT "this is not a wildcard" 3600`,
+		"host1.example. A 192.0.2.1 3600",
+		`_ssh._tcp.host1.example. SRV \# 7 00000000001600 3600`,
+		`_ssh._tcp.host2.example. SRV \# 7 00000000001600 3600`,
+	)
+	cases := []struct {
+		qname string
+		qtype uint16
+		rcode uint16
+		want  string // formatted rdata of the first answer, "" for none
+	}{
+		// synthesized
+		{"host3.example.", type_mx, rcode_noerror, "10 host1.example."},
+		{"host3.example.", type_a, rcode_noerror, ""},
+		{"foo.bar.example.", type_txt, rcode_noerror, `"this is a wildcard"`},
+		// not synthesized
+		{"host1.example.", type_mx, rcode_noerror, ""},
+		{"sub.*.example.", type_mx, rcode_noerror, ""},
+		{"_telnet._tcp.host1.example.", 33, rcode_nxdomain, ""},
+		{"ghost.*.example.", type_mx, rcode_nxdomain, ""},
+		// empty non-terminals exist, so they are NODATA and block the wildcard
+		{"_tcp.host1.example.", type_txt, rcode_noerror, ""},
+		{"host2.example.", type_txt, rcode_noerror, ""},
+		// the asterisk label itself is an ordinary name
+		{"*.example.", type_txt, rcode_noerror, `"this is a wildcard"`},
+	}
+	for _, c := range cases {
+		res := zone.answerQuery(c.qname, c.qtype)
+		got := ""
+		if len(res.Answer) > 0 {
+			got = formatRdata(res.Answer[0].Type_, res.Answer[0].Rdata)
+			if res.Answer[0].Name != c.qname {
+				t.Errorf("%s %s: owner %s, want the query name", c.qname, typeToString(c.qtype), res.Answer[0].Name)
+			}
+		}
+		if res.Rcode != c.rcode || got != c.want {
+			t.Errorf("%s %s: rcode %d answer %q, want rcode %d answer %q", c.qname, typeToString(c.qtype), res.Rcode, got, c.rcode, c.want)
+		}
+		if len(res.Answer) == 0 && (len(res.Authority) != 1 || res.Authority[0].Type_ != type_soa || res.Authority[0].TTL != 300) {
+			t.Errorf("%s %s: negative answer should carry the SOA with the minimum ttl, got %+v", c.qname, typeToString(c.qtype), res.Authority)
+		}
+	}
+}
+
+func TestDelegationReferral(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"example.com. NS ns1.example.com. 3600",
+		"ns1.example.com. A 192.0.2.53 3600",
+		"sub.example.com. NS ns1.sub.example.com. 3600",
+		"sub.example.com. NS ns2.example.com. 3600",
+		"sub.example.com. NS ns.example.net. 3600",
+		"sub.example.com. TYPE43 \\# 4 30390801 3600",
+		"ns1.sub.example.com. A 192.0.2.1 3600",
+		"ns2.example.com. AAAA 2001:db8::2 3600",
+		"www.sub.example.com. A 192.0.2.80 3600",
+		"*.example.com. A 192.0.2.99 3600",
+		"alias.example.com. CNAME www.sub.example.com. 3600",
+	)
+	for _, qname := range []string{"sub.example.com.", "www.sub.example.com.", "ns1.sub.example.com.", "deep.missing.sub.example.com."} {
+		res := zone.answerQuery(qname, type_a)
+		if !res.Referral || len(res.Answer) != 0 || res.Rcode != rcode_noerror {
+			t.Errorf("%s: expected a referral, got %+v", qname, res)
+			continue
+		}
+		if len(res.Authority) != 3 {
+			t.Errorf("%s: expected the 3 NS records in authority, got %d", qname, len(res.Authority))
+		}
+		var glue []string
+		for _, r := range res.Additional {
+			glue = append(glue, r.Name+" "+formatRdata(r.Type_, r.Rdata))
+		}
+		if strings.Join(glue, ",") != "ns1.sub.example.com. 192.0.2.1,ns2.example.com. 2001:db8::2" {
+			t.Errorf("%s: glue %v", qname, glue)
+		}
+	}
+
+	// DS lives on the parent side of the cut
+	if res := zone.answerQuery("sub.example.com.", type_ds); res.Referral || len(res.Answer) != 1 {
+		t.Errorf("DS at the cut should be answered authoritatively, got %+v", res)
+	}
+	// a CNAME into delegated space stops at the cut
+	if res := zone.answerQuery("alias.example.com.", type_a); res.Referral || len(res.Answer) != 1 || res.Answer[0].Type_ != type_cname {
+		t.Errorf("CNAME into a delegation: %+v", res)
+	}
+	// the wildcard still works outside the cut
+	if res := zone.answerQuery("other.example.com.", type_a); res.Referral || len(res.Answer) != 1 {
+		t.Errorf("wildcard next to a delegation: %+v", res)
+	}
+}
+
+// testQuery builds a query message for name/qtype
+func testQuery(name string, qtype uint16) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, dns_header{Id: 0x1234, Flags: rd_mask, Qdcount: 1})
+	write_name(buf, name)
+	binary.Write(buf, binary.BigEndian, qtype)
+	binary.Write(buf, binary.BigEndian, uint16(class_in))
+	return buf.Bytes()
+}
+
+func TestAdditionalSection(t *testing.T) {
+	lines := []string{
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"example.com. NS ns1.example.com. 3600",
+		"example.com. NS ns.example.net. 3600",
+		"example.com. MX 10 mail.example.com. 3600",
+		"example.com. MX 20 mail.example.net. 3600",
+		"_sip._tcp.example.com. SRV 10 5 5060 sip.example.com. 3600",
+		"ns1.example.com. A 192.0.2.53 3600",
+		"mail.example.com. A 192.0.2.25 3600",
+		"mail.example.com. AAAA 2001:db8::25 3600",
+		"sip.example.com. A 192.0.2.60 3600",
+		"pool.example.com. MX 10 big.example.com. 3600",
+	}
+	for i := 0; i < 40; i++ {
+		lines = append(lines, "big.example.com. A 192.0.2."+strconv.Itoa(i)+" 3600")
+	}
+	testZone(t, lines...)
+	analyticsFile = t.TempDir() + "/analytics.log"
+	minimalResponses = false
+
+	check := func(qname string, qtype uint16, wantAdditional int, wantTC bool) *dns_msg {
+		t.Helper()
+		msg, err := parse_full_msg(answer_msg(testQuery(qname, qtype), nil, false))
+		if err != nil {
+			t.Fatalf("%s: %v", qname, err)
+		}
+		if len(msg.Additional) != wantAdditional || (msg.Hdr.Flags&tc_mask != 0) != wantTC {
+			t.Errorf("%s %s: %d additional tc=%v, want %d tc=%v", qname, typeToString(qtype),
+				len(msg.Additional), msg.Hdr.Flags&tc_mask != 0, wantAdditional, wantTC)
+		}
+		return msg
+	}
+	msg := check("example.com.", type_mx, 2, false)
+	if msg.Additional[0].Name != "mail.example.com." || msg.Hdr.Flags&aa_mask == 0 || msg.Hdr.Flags&rd_mask == 0 {
+		t.Errorf("unexpected MX response %+v", msg)
+	}
+	check("example.com.", type_ns, 1, false)
+	check("_sip._tcp.example.com.", type_srv, 1, false)
+
+	minimalResponses = true
+	check("example.com.", type_mx, 0, false)
+	minimalResponses = false
+
+	// additional records that don't fit are dropped without setting TC
+	msg = check("pool.example.com.", type_mx, 13, false)
+	if len(msg.Answer) != 1 {
+		t.Errorf("MX answer lost: %+v", msg.Answer)
+	}
+
+	// the answer doesn't fit in 512 bytes: only the question comes back
+	msg = check("big.example.com.", type_a, 0, true)
+	if len(msg.Answer) != 0 {
+		t.Errorf("truncated response still has %d answers", len(msg.Answer))
+	}
+	if resp := answer_msg(testQuery("big.example.com.", type_a), nil, true); len(resp) <= 512 {
+		t.Error("tcp sized response should carry the full answer")
+	}
+}
+
+func TestMinimalANY(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+		"www.example.com. A 192.0.2.2 3600",
+		"www.example.com. TXT \"hello\" 3600",
+	)
+	analyticsFile = t.TempDir() + "/analytics.log"
+	defer func() { anyPolicy = "hinfo" }()
+
+	query := func(tcp bool) *dns_msg {
+		t.Helper()
+		msg, err := parse_full_msg(answer_msg(testQuery("www.example.com.", 255), nil, tcp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	anyPolicy = "hinfo"
+	msg := query(false)
+	if len(msg.Answer) != 1 || msg.Answer[0].Type_ != type_hinfo || msg.Answer[0].TTL != 3789 ||
+		formatRdata(type_hinfo, msg.Answer[0].Rdata) != `"RFC8482" ""` {
+		t.Errorf("hinfo policy: %+v", msg.Answer)
+	}
+	if msg := query(true); len(msg.Answer) != 3 {
+		t.Errorf("tcp should get the full answer, got %d records", len(msg.Answer))
+	}
+
+	anyPolicy = "rrset"
+	msg = query(false)
+	if len(msg.Answer) != 2 || msg.Answer[0].Type_ != msg.Answer[1].Type_ {
+		t.Errorf("rrset policy: %+v", msg.Answer)
+	}
+
+	anyPolicy = "full"
+	if msg := query(false); len(msg.Answer) != 3 {
+		t.Errorf("full policy: %d records", len(msg.Answer))
+	}
+
+	// NXDOMAIN is left alone
+	anyPolicy = "hinfo"
+	msg, _ = parse_full_msg(answer_msg(testQuery("nope.example.com.", 255), nil, false))
+	if len(msg.Answer) != 0 || msg.Hdr.Flags&rcode_mask != rcode_nxdomain {
+		t.Errorf("ANY for a missing name: %+v", msg)
+	}
+}
+
+func TestQueryNameCase(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. CNAME web.example.com. 3600",
+		"web.example.com. A 192.0.2.1 3600",
+		"*.wild.example.com. A 192.0.2.2 3600",
+	)
+	analyticsFile = t.TempDir() + "/analytics.log"
+	for _, tc := range []struct{ qname, last string }{
+		{"WwW.ExAmPlE.cOm.", "web.example.com."},
+		{"Foo.WILD.example.COM.", "Foo.WILD.example.COM."},
+	} {
+		msg, err := parse_full_msg(answer_msg(testQuery(tc.qname, type_a), nil, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fqdn(msg.Questions[0].Name) != tc.qname {
+			t.Errorf("question name %q, want %q", msg.Questions[0].Name, tc.qname)
+		}
+		if len(msg.Answer) == 0 || msg.Answer[0].Name != tc.qname || msg.Answer[len(msg.Answer)-1].Name != tc.last {
+			t.Errorf("%s: answer owners %+v", tc.qname, msg.Answer)
+		}
+	}
+}
+
+func TestTCPQueries(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+	)
+	analyticsFile = t.TempDir() + "/analytics.log"
+	client, server := net.Pipe()
+	go handle_tcp_conn(server)
+	defer client.Close()
+	// two queries on one connection
+	for i := 0; i < 2; i++ {
+		if err := write_tcp_msg(client, testQuery("www.example.com.", type_a)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := read_tcp_msg(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := parse_full_msg(resp)
+		if err != nil || len(msg.Answer) != 1 || msg.Hdr.Id != 0x1234 {
+			t.Fatalf("tcp answer %d: %+v %v", i, msg, err)
+		}
+	}
+}
+
+func TestZoneTreeEmptyNonTerminals(t *testing.T) {
+	tree := newZoneTree()
+	a := rr{Name: "a.b.example.com.", Type_: type_a, Class: class_in, Rdata: net.ParseIP("192.0.2.1").To4()}
+	tree.add(a)
+	if !tree.exists("b.example.com.") || !tree.exists("example.com.") || len(tree.get("b.example.com.")) != 0 {
+		t.Error("ancestors of a.b.example.com. should exist as empty non-terminals")
+	}
+	if tree.exists("c.example.com.") || tree.exists("x.a.b.example.com.") {
+		t.Error("unrelated names should not exist")
+	}
+
+	// the ENT becomes a real name and back
+	tree.add(rr{Name: "b.example.com.", Type_: type_txt, Class: class_in, Rdata: []byte{0}})
+	tree.set("b.example.com.", nil)
+	if !tree.exists("b.example.com.") {
+		t.Error("b.example.com. is still an empty non-terminal")
+	}
+	tree.set("a.b.example.com.", nil)
+	if tree.exists("b.example.com.") || tree.exists("com.") || len(tree.nodes) != 0 {
+		t.Errorf("removing the last name should remove every ENT, left %v", tree.nodes)
+	}
+
+	// lookups see the difference: NODATA for the ENT, NXDOMAIN for the missing name
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"a.b.example.com. A 192.0.2.1 3600",
+	)
+	if res := zone.answerQuery("b.example.com.", type_a); res.Rcode != rcode_noerror || len(res.Answer) != 0 {
+		t.Errorf("empty non-terminal should be NODATA, got %+v", res)
+	}
+	if res := zone.answerQuery("c.example.com.", type_a); res.Rcode != rcode_nxdomain {
+		t.Errorf("missing name should be NXDOMAIN, got %+v", res)
+	}
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	// RFC 4034 section 6.1, lowercased
+	want := []string{"example.", "a.example.", "yljkjljk.a.example.", "z.a.example.", "zabc.a.example.",
+		"z.example.", "\x01.z.example.", "*.z.example.", "\x80.z.example."}
+	m := map[string][]rr{}
+	for i := len(want) - 1; i >= 0; i-- {
+		m[want[i]] = []rr{{Name: want[i], Type_: type_txt, Class: class_in, Rdata: []byte{0}}}
+	}
+	got := zoneFromMap(m).names()
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("canonical order:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestAnswerOrdering(t *testing.T) {
+	testZone(t)
+	rotations = map[string]int{}
+	path := filepath.Join(t.TempDir(), "zone.txt")
+	data := `$ORDER example.com. round-robin
+$ORDER w.example.com. weighted
+example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600
+rr.example.com. A 192.0.2.1 300
+rr.example.com. A 192.0.2.2 300
+rr.example.com. A 192.0.2.3 300 ; see url=https://wiki.example.com/dns?a=b
+w.example.com. A 192.0.2.10 300 ; weight=9
+w.example.com. A 192.0.2.11 300 ; the small one weight=1
+*.wc.example.com. A 192.0.2.20 300
+*.wc.example.com. A 192.0.2.21 300
+example.com. TXT "a;b" 300
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := load_zone(zone, path); err != nil {
+		t.Fatal(err)
+	}
+	if txt := zone.get("example.com."); len(txt) != 2 || formatRdata(type_txt, txt[1].Rdata) != `"a;b"` {
+		t.Errorf("quoted ';' should not start a comment: %+v", txt)
+	}
+
+	var firsts []string
+	for i := 0; i < 4; i++ {
+		res := zone.answerQuery("rr.example.com.", type_a)
+		if len(res.Answer) != 3 {
+			t.Fatalf("round-robin answer: %+v", res.Answer)
+		}
+		firsts = append(firsts, net.IP(res.Answer[0].Rdata).String())
+	}
+	if strings.Join(firsts, " ") != "192.0.2.1 192.0.2.2 192.0.2.3 192.0.2.1" {
+		t.Errorf("round-robin order %v", firsts)
+	}
+	if got := net.IP(zone.get("rr.example.com.")[0].Rdata).String(); got != "192.0.2.1" {
+		t.Errorf("zone data was reordered, first record is %s", got)
+	}
+	// names a wildcard matches share one counter, whatever clients ask for
+	for _, name := range []string{"a.wc.example.com.", "b.wc.example.com.", "c.wc.example.com."} {
+		zone.answerQuery(name, type_a)
+	}
+	if _, ok := rotations["*.wc.example.com. A"]; !ok || len(rotations) != 2 {
+		t.Errorf("round-robin counters %v", rotations)
+	}
+
+	heavy := 0
+	for i := 0; i < 1000; i++ {
+		res := zone.answerQuery("w.example.com.", type_a)
+		if len(res.Answer) != 2 {
+			t.Fatalf("weighted answer: %+v", res.Answer)
+		}
+		if net.IP(res.Answer[0].Rdata).String() == "192.0.2.10" {
+			heavy++
+		}
+	}
+	if heavy < 800 || heavy > 970 {
+		t.Errorf("weight 9 record came first %d/1000 times, want about 900", heavy)
+	}
+
+	// policies and weights survive a save
+	if err := save_zone(zone, path); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(path)
+	for _, want := range []string{"$ORDER w.example.com. weighted\n", "w.example.com. A 192.0.2.10 300 ; weight=9\n"} {
+		if !strings.Contains(string(saved), want) {
+			t.Errorf("saved zone is missing %q:\n%s", want, saved)
+		}
+	}
+	if err := zone.setOrderPolicy("example.com.", "sideways"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
@@ -0,0 +1,189 @@
+// DNS NOTIFY (RFC 1996): tell secondaries a zone changed instead of waiting
+// for their next refresh
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const opcode_notify = 4
+
+type notifyConfig struct {
+	Targets []string // "host:port" of the secondaries to notify
+	KeyName string   // TSIG key (from setupAXFR) to sign with, "" for unsigned
+}
+
+var notifyConf notifyConfig
+
+// first retry interval, doubling after every unanswered try (RFC 1996 section 3.6)
+var notifyRetry = 2 * time.Second
+
+// tries before giving up on a target until the next change
+var notifyMaxTries = 6
+
+// notifyState is where sending one zone's NOTIFY to one target got to
+type notifyState struct {
+	Zone   string
+	Target string
+	Serial uint32
+	Tries  int
+	Acked  bool
+	Err    string
+	Sent   time.Time
+}
+
+// states by zone + " " + target
+var notifyStates = map[string]*notifyState{}
+var notifyMu sync.Mutex
+
+// notify config (to call while dns startup). targets without a port get 53
+func setupNotify(targets []string, keyName string) {
+	notifyConf.Targets = nil
+	for _, t := range targets {
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			t = net.JoinHostPort(t, "53")
+		}
+		notifyConf.Targets = append(notifyConf.Targets, t)
+	}
+	notifyConf.KeyName = keyName
+}
+
+// notifyZone tells every target that apex is now at serial. it returns right
+// away, the sending and retrying happens in the background
+func notifyZone(apex string, serial uint32) {
+	for _, target := range notifyConf.Targets {
+		st := &notifyState{Zone: apex, Target: target, Serial: serial}
+		notifyMu.Lock()
+		notifyStates[apex+" "+target] = st // replaces (and so stops) the retries for an older serial
+		notifyMu.Unlock()
+		go sendNotify(st)
+	}
+}
+
+// sendNotify sends until the target acknowledges, the tries run out or a newer
+// change takes over
+func sendNotify(st *notifyState) {
+	wait := notifyRetry
+	for {
+		notifyMu.Lock()
+		if notifyStates[st.Zone+" "+st.Target] != st {
+			notifyMu.Unlock()
+			return
+		}
+		st.Tries++
+		st.Sent = time.Now()
+		notifyMu.Unlock()
+
+		err := notifyOnce(st.Target, st.Zone, st.Serial, wait)
+
+		notifyMu.Lock()
+		st.Acked = err == nil
+		st.Err = ""
+		if err != nil {
+			st.Err = err.Error()
+		}
+		done := err == nil || st.Tries >= notifyMaxTries
+		notifyMu.Unlock()
+		if err != nil {
+			log.Printf("NOTIFY %s serial %d to %s, try %d: %v", st.Zone, st.Serial, st.Target, st.Tries, err)
+		}
+		if done {
+			return
+		}
+		time.Sleep(time.Until(st.Sent.Add(wait))) // an error answer comes back early
+		wait *= 2
+	}
+}
+
+// notifyOnce sends one NOTIFY and waits up to timeout for the answer
+func notifyOnce(target, apex string, serial uint32, timeout time.Duration) error {
+	msg, err := notifyMessage(apex, serial)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(msg)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		resp, err := parse_full_msg(buf[:n])
+		if err != nil || resp.Hdr.Id != id || resp.Hdr.Flags&qr_mask == 0 || (resp.Hdr.Flags&opcode_mask)>>11 != opcode_notify {
+			continue // not the answer to this NOTIFY
+		}
+		if rcode := resp.Hdr.Flags & rcode_mask; rcode != rcode_noerror {
+			return errors.New("answered with rcode " + strconv.Itoa(int(rcode)))
+		}
+		return nil
+	}
+}
+
+// notifyMessage is a NOTIFY for apex, with the new SOA serial as a hint in the
+// answer section (RFC 1996 section 3.7), signed when a notify key is set
+func notifyMessage(apex string, serial uint32) ([]byte, error) {
+	id := uint16(rand.Intn(1 << 16))
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, dns_header{Id: id, Flags: opcode_notify<<11 | aa_mask, Qdcount: 1, Ancount: 1})
+	write_name(buf, apex)
+	binary.Write(buf, binary.BigEndian, uint16(type_soa))
+	binary.Write(buf, binary.BigEndian, uint16(class_in))
+	soa, err := parseRdata(type_soa, []string{".", ".", strconv.FormatUint(uint64(serial), 10), "0", "0", "0", "0"})
+	if err != nil {
+		return nil, err
+	}
+	write_rr(buf, makeRR(apex, type_soa, 0, soa))
+	if notifyConf.KeyName == "" {
+		return buf.Bytes(), nil
+	}
+	key := getTSIGKey(notifyConf.KeyName)
+	if key == nil {
+		return nil, errors.New("unknown notify key " + notifyConf.KeyName)
+	}
+	if !keyAllows(key, keyUseNotify) {
+		return nil, errors.New("key " + key.Name + " may not be used for NOTIFY")
+	}
+	t := &tsigRecord{
+		Name:       fqdn(key.Name),
+		Algorithm:  fqdn(key.Algorithm),
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      300,
+		OrigID:     id,
+	}
+	return signTSIG(buf.Bytes(), key, nil, t, false)
+}
+
+// notifyStatus lists the NOTIFY states for the web ui, by zone then target
+func notifyStatus() []notifyState {
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+	var out []notifyState
+	for _, st := range notifyStates {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Zone != out[j].Zone {
+			return out[i].Zone < out[j].Zone
+		}
+		return out[i].Target < out[j].Target
+	})
+	return out
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	setupAXFR([]string{"127.0.0.1"}, []tsigKey{{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256}})
+	setupNotify([]string{pc.LocalAddr().String()}, "axfr-key.")
+	notifyRetry = 50 * time.Millisecond
+	defer func() {
+		setupNotify(nil, "")
+		notifyRetry = 2 * time.Second
+	}()
+
+	// the secondary ignores the first NOTIFY and answers the second
+	got := make(chan *dns_msg, 4)
+	go func() {
+		buf := make([]byte, 4096)
+		for i := 0; ; i++ {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, _, tsigErr, err := verifyTSIG(buf[:n], time.Now()); err != nil || tsigErr != 0 {
+				t.Errorf("NOTIFY signature: %v %d", err, tsigErr)
+			}
+			msg, err := parse_full_msg(buf[:n])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got <- msg
+			if i == 0 {
+				continue
+			}
+			resp, _ := build_message(msg.Hdr, msg.Questions[0], queryResult{})
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 41 3600 600 86400 300 3600",
+	)
+	zone.change("example.com.", nil, []rr{makeRR("www.example.com.", type_a, 300, []byte{192, 0, 2, 1})})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-got:
+			if (msg.Hdr.Flags&opcode_mask)>>11 != opcode_notify || msg.Questions[0].Name != "example.com" ||
+				len(msg.Answer) != 1 || msg.Answer[0].SOA == nil || msg.Answer[0].SOA.Serial != 42 {
+				t.Errorf("NOTIFY %d: %+v", i, msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("NOTIFY %d never arrived", i)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st := notifyStatus()
+		if len(st) == 1 && st[0].Acked {
+			if st[0].Tries != 2 || st[0].Serial != 42 {
+				t.Errorf("status %+v", st[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("NOTIFY never acknowledged: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,116 @@
+// answer ordering for A/AAAA RRsets, so multiple addresses actually spread load
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	orderFixed      = "fixed"       // zone file order, the default
+	orderRoundRobin = "round-robin" // rotate by one on every answer
+	orderRandom     = "random"      // shuffle every answer
+	orderWeighted   = "weighted"    // random, records with a higher weight= come first more often
+)
+
+// round-robin position per RRset (owner name + type, the wildcard for names it matched)
+var rotations = map[string]int{}
+var rotationsMu sync.Mutex
+
+// setOrderPolicy sets the ordering of the RRsets at and below name, from a
+// "$ORDER <name> <policy>" line in the zone file. a policy applies to the name
+// and everything below it unless a closer name has its own, so setting it on
+// the apex covers the whole zone
+func (z *zoneTree) setOrderPolicy(name, policy string) error {
+	policy = strings.ToLower(policy)
+	switch policy {
+	case orderFixed, orderRoundRobin, orderRandom, orderWeighted:
+	default:
+		return fmt.Errorf("unknown order policy %q", policy)
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.order[fqdn(strings.ToLower(name))] = policy
+	return nil
+}
+
+// orderPolicy finds the policy for name from the closest name that sets one
+func (z *zoneTree) orderPolicy(name string) string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	for {
+		if p, ok := z.order[name]; ok {
+			return p
+		}
+		if name == "." {
+			return orderFixed
+		}
+		name = parentName(name)
+	}
+}
+
+// orderPolicyLines returns the $ORDER directives for save_zone, sorted by name
+func (z *zoneTree) orderPolicyLines() []string {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	var lines []string
+	for name, p := range z.order {
+		lines = append(lines, "$ORDER "+name+" "+p)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// orderAnswers puts an A or AAAA RRset for name in the order its policy asks
+// for. the zone data itself is never reordered, only the copy being answered
+func (z *zoneTree) orderAnswers(name string, rrs []rr) []rr {
+	if len(rrs) < 2 {
+		return rrs
+	}
+	out := make([]rr, 0, len(rrs))
+	switch z.orderPolicy(name) {
+	case orderRoundRobin:
+		// by owner name, so names matched by a wildcard all share its counter
+		key := rrs[0].Name + " " + typeToString(rrs[0].Type_)
+		rotationsMu.Lock()
+		k := rotations[key] % len(rrs)
+		rotations[key] = k + 1
+		rotationsMu.Unlock()
+		out = append(append(out, rrs[k:]...), rrs[:k]...)
+	case orderRandom:
+		for _, i := range rand.Perm(len(rrs)) {
+			out = append(out, rrs[i])
+		}
+	case orderWeighted:
+		// pick one at a time with probability weight/remaining total
+		left := append([]rr(nil), rrs...)
+		for len(left) > 0 {
+			total := 0
+			for _, r := range left {
+				total += recordWeight(r)
+			}
+			n := rand.Intn(total)
+			i := 0
+			for n >= recordWeight(left[i]) {
+				n -= recordWeight(left[i])
+				i++
+			}
+			out = append(out, left[i])
+			left = append(left[:i], left[i+1:]...)
+		}
+	default:
+		return rrs
+	}
+	return out
+}
+
+// recordWeight is the weight= option of a record, 1 when it has none
+func recordWeight(r rr) int {
+	if r.Weight == 0 {
+		return 1
+	}
+	return int(r.Weight)
+}
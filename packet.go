@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"log"
 	"strings"
 )
@@ -28,7 +29,7 @@ func parse_dns_msg(data []byte) (dns_header, dns_question, error) {
 	return hdr, q, nil
 }
 
-// reading dns name (labels)
+// reading dns name (labels), following compression pointers into msg
 func read_name(r *bytes.Reader, msg []byte) (string, error) {
 	var labels []string
 	for {
@@ -39,8 +40,26 @@ func read_name(r *bytes.Reader, msg []byte) (string, error) {
 		if b == 0 {
 			break
 		}
+		if b&0xc0 == 0xc0 {
+			// compression pointer: the rest of the name lives earlier in the message
+			b2, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			rest, err := read_name_at(msg, int(b&0x3f)<<8|int(b2), 0)
+			if err != nil {
+				return "", err
+			}
+			if rest != "" {
+				labels = append(labels, rest)
+			}
+			break
+		}
+		if b > 63 {
+			return "", errors.New("bad label length")
+		}
 		buf := make([]byte, b)
-		if _, err := r.Read(buf); err != nil {
+		if _, err := io.ReadFull(r, buf); err != nil {
 			return "", err
 		}
 		labels = append(labels, string(buf))
@@ -48,6 +67,153 @@ func read_name(r *bytes.Reader, msg []byte) (string, error) {
 	return strings.Join(labels, "."), nil
 }
 
+// read_name_at reads a name at a pointer target; depth stops pointer loops
+func read_name_at(msg []byte, off int, depth int) (string, error) {
+	if depth > 10 || off >= len(msg) {
+		return "", errors.New("bad compression pointer")
+	}
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return "", errors.New("name runs past end of message")
+		}
+		b := int(msg[off])
+		if b == 0 {
+			break
+		}
+		if b&0xc0 == 0xc0 {
+			if off+1 >= len(msg) {
+				return "", errors.New("bad compression pointer")
+			}
+			rest, err := read_name_at(msg, (b&0x3f)<<8|int(msg[off+1]), depth+1)
+			if err != nil {
+				return "", err
+			}
+			if rest != "" {
+				labels = append(labels, rest)
+			}
+			break
+		}
+		if b > 63 || off+1+b > len(msg) {
+			return "", errors.New("bad label length")
+		}
+		labels = append(labels, string(msg[off+1:off+1+b]))
+		off += 1 + b
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// read_rr reads one resource record. names inside the rdata of the RFC 1035
+// types that may be compressed are expanded so Rdata is always self contained
+func read_rr(r *bytes.Reader, msg []byte) (rr, error) {
+	var out rr
+	name, err := read_name(r, msg)
+	if err != nil {
+		return out, err
+	}
+	var fixed struct {
+		Type_ uint16
+		Class uint16
+		TTL   uint32
+		Len   uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return out, err
+	}
+	start := len(msg) - r.Len()
+	rdata := make([]byte, fixed.Len)
+	if _, err := io.ReadFull(r, rdata); err != nil {
+		return out, err
+	}
+	switch fixed.Type_ {
+	case type_ns, type_cname, type_ptr, type_mx, type_soa:
+		if fixed.Len == 0 {
+			break // no rdata, like the deletes of an UPDATE (RFC 2136 section 2.5)
+		}
+		rdata, err = expand_rdata_names(fixed.Type_, msg, start, int(fixed.Len))
+		if err != nil {
+			return out, err
+		}
+	}
+	out = makeRR(fqdn(name), fixed.Type_, fixed.TTL, rdata)
+	out.Class = fixed.Class
+	return out, nil
+}
+
+// expand_rdata_names re-encodes rdata at msg[start:start+n] without compression
+func expand_rdata_names(t uint16, msg []byte, start, n int) ([]byte, error) {
+	rd := bytes.NewReader(msg[:start+n])
+	rd.Seek(int64(start), io.SeekStart)
+	buf := &bytes.Buffer{}
+	if t == type_mx {
+		var pref uint16
+		if err := binary.Read(rd, binary.BigEndian, &pref); err != nil {
+			return nil, err
+		}
+		binary.Write(buf, binary.BigEndian, pref)
+	}
+	names := 1
+	if t == type_soa {
+		names = 2
+	}
+	for i := 0; i < names; i++ {
+		name, err := read_name(rd, msg)
+		if err != nil {
+			return nil, err
+		}
+		write_name(buf, name)
+	}
+	rest := make([]byte, rd.Len())
+	io.ReadFull(rd, rest)
+	if t == type_soa && len(rest) != 20 {
+		return nil, errors.New("bad soa rdata")
+	}
+	buf.Write(rest)
+	return buf.Bytes(), nil
+}
+
+// parse_full_msg parses every section of a dns message
+func parse_full_msg(data []byte) (*dns_msg, error) {
+	if len(data) < 12 {
+		return nil, errors.New("packet too short")
+	}
+	m := &dns_msg{}
+	r := bytes.NewReader(data)
+	binary.Read(r, binary.BigEndian, &m.Hdr)
+	for i := 0; i < int(m.Hdr.Qdcount); i++ {
+		name, err := read_name(r, data)
+		if err != nil {
+			return nil, err
+		}
+		q := dns_question{Name: name}
+		if err := binary.Read(r, binary.BigEndian, &q.Type_); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &q.Class); err != nil {
+			return nil, err
+		}
+		m.Questions = append(m.Questions, q)
+	}
+	sections := []struct {
+		count uint16
+		dst   *[]rr
+	}{
+		{m.Hdr.Ancount, &m.Answer},
+		{m.Hdr.Nscount, &m.Authority},
+		{m.Hdr.Arcount, &m.Additional},
+	}
+	for _, sec := range sections {
+		for i := 0; i < int(sec.count); i++ {
+			rec, err := read_rr(r, data)
+			if err != nil {
+				return nil, err
+			}
+			*sec.dst = append(*sec.dst, rec)
+		}
+	}
+	return m, nil
+}
+
 // writing dns name
 func write_name(w *bytes.Buffer, name string) {
 	// Remove trailing dot if present, as Split will create an empty label for it,
@@ -56,6 +222,10 @@ func write_name(w *bytes.Buffer, name string) {
 		name = name[:len(name)-1]
 	}
 	// strings.TrimSuffix(name, ".")
+	if name == "" {
+		w.WriteByte(0) // root name is just the terminator
+		return
+	}
 	for _, label := range strings.Split(name, ".") {
 		w.WriteByte(byte(len(label)))
 		w.WriteString(label)
@@ -87,22 +257,58 @@ func write_rr(w *bytes.Buffer, rr rr) {
 
 // build dns response
 func build_response(hdr dns_header, q dns_question, answers []rr, ns []rr) ([]byte, error) {
-	hdr.Flags = qr_mask | aa_mask
+	return build_message(hdr, q, queryResult{Answer: answers, Authority: ns})
+}
+
+// build_message writes a response with the rcode and sections of res.
+// the query's opcode and RD bit are echoed back
+func build_message(hdr dns_header, q dns_question, res queryResult) ([]byte, error) {
+	hdr.Flags = qr_mask | aa_mask | hdr.Flags&(opcode_mask|rd_mask) | res.Rcode&rcode_mask
+	if res.Referral {
+		hdr.Flags &^= aa_mask
+	}
+	if res.Truncated {
+		hdr.Flags |= tc_mask
+	}
 	hdr.Qdcount = 1
-	hdr.Ancount = uint16(len(answers))
-	hdr.Nscount = uint16(len(ns))
-	hdr.Arcount = 0
+	hdr.Ancount = uint16(len(res.Answer))
+	hdr.Nscount = uint16(len(res.Authority))
+	hdr.Arcount = uint16(len(res.Additional))
 	buf := &bytes.Buffer{}
 	binary.Write(buf, binary.BigEndian, hdr)
 	write_name(buf, q.Name)
 	binary.Write(buf, binary.BigEndian, q.Type_)
 	binary.Write(buf, binary.BigEndian, q.Class)
-	for _, r := range answers {
+	for _, r := range res.Answer {
 		write_rr(buf, r)
 	}
-	for _, r := range ns {
+	for _, r := range res.Authority {
+		write_rr(buf, r)
+	}
+	for _, r := range res.Additional {
 		write_rr(buf, r)
 	}
 	log.Printf("DEBUG: DNS Response Packet Length: %d bytes", buf.Len())
 	return buf.Bytes(), nil
 }
+
+// fit_message builds the response and makes it fit in maxSize bytes. additional
+// records are dropped first without setting TC (RFC 2181 section 9), except
+// glue below a referral's cut, which RFC 9471 says must fit. if the answer
+// still doesn't fit only the question goes back, with TC set
+func fit_message(hdr dns_header, q dns_question, res queryResult, maxSize int) ([]byte, error) {
+	for {
+		msg, err := build_message(hdr, q, res)
+		if err != nil || len(msg) <= maxSize {
+			return msg, err
+		}
+		if n := len(res.Additional); n > 0 {
+			last := res.Additional[n-1]
+			if !res.Referral || len(res.Authority) == 0 || !isBelow(strings.ToLower(last.Name), res.Authority[0].Name) {
+				res.Additional = res.Additional[:n-1]
+				continue
+			}
+		}
+		return build_message(hdr, q, queryResult{Rcode: res.Rcode, Referral: res.Referral, Truncated: true})
+	}
+}
@@ -0,0 +1,530 @@
+// record data: zone file presentation format <-> wire format
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// typeNames maps rr type codes to their zone file mnemonics.
+// anything not listed here is written as TYPEnnn (RFC 3597)
+var typeNames = map[uint16]string{
+	type_a:     "A",
+	type_ns:    "NS",
+	type_cname: "CNAME",
+	type_soa:   "SOA",
+	type_ptr:   "PTR",
+	type_hinfo: "HINFO",
+	type_mx:    "MX",
+	type_txt:   "TXT",
+	type_aaaa:  "AAAA",
+	type_loc:   "LOC",
+	type_srv:   "SRV",
+	type_naptr: "NAPTR",
+	type_sshfp: "SSHFP",
+	type_tlsa:  "TLSA",
+	type_svcb:  "SVCB",
+	type_https: "HTTPS",
+	type_uri:   "URI",
+	type_alias: "ALIAS",
+	255:        "ANY",
+}
+
+// stringToType maps a type mnemonic or TYPEnnn back to the type code
+func stringToType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for code, name := range typeNames {
+		if name == s {
+			return code, true
+		}
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
+
+// fqdn makes sure a name ends with the root label
+func fqdn(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// encodeName writes a domain name in uncompressed wire format, checking label sizes
+func encodeName(name string) ([]byte, error) {
+	name = fqdn(name)
+	if name != "." {
+		for _, label := range strings.Split(name[:len(name)-1], ".") {
+			if label == "" {
+				return nil, fmt.Errorf("empty label in %q", name)
+			}
+			if len(label) > 63 {
+				return nil, fmt.Errorf("label too long in %q", name)
+			}
+		}
+	}
+	if len(name) > 254 {
+		return nil, fmt.Errorf("name too long: %q", name)
+	}
+	buf := &bytes.Buffer{}
+	write_name(buf, name)
+	return buf.Bytes(), nil
+}
+
+// readRdataName reads an uncompressed name from rdata starting at off.
+// unlike decode_name it never panics on short data
+func readRdataName(data []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(data) {
+			return "", 0, errors.New("name runs past end of rdata")
+		}
+		sz := int(data[off])
+		off++
+		if sz == 0 {
+			break
+		}
+		if sz > 63 || off+sz > len(data) {
+			return "", 0, errors.New("bad label in rdata name")
+		}
+		labels = append(labels, string(data[off:off+sz]))
+		off += sz
+	}
+	return strings.Join(labels, ".") + ".", off, nil
+}
+
+// parseRdata turns the rdata fields of a zone file line into wire format.
+// every type accepts the RFC 3597 generic form: \# <length> <hex>
+func parseRdata(t uint16, fields []string) ([]byte, error) {
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseGenericRdata(t, fields[1:])
+	}
+	return parseTypedRdata(t, fields)
+}
+
+// parseTextRdata is parseRdata for fields split by zoneFields: a quoted "\#"
+// is text, not the generic marker
+func parseTextRdata(t uint16, fields []string, quoted []bool) ([]byte, error) {
+	if len(quoted) > 0 && quoted[0] {
+		return parseTypedRdata(t, fields)
+	}
+	return parseRdata(t, fields)
+}
+
+// parseTypedRdata parses rdata in the type's own presentation format
+func parseTypedRdata(t uint16, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("missing rdata")
+	}
+	switch t {
+	case type_a:
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil || len(fields) != 1 {
+			return nil, fmt.Errorf("bad ipv4 address %q", fields[0])
+		}
+		return ip, nil
+	case type_aaaa:
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil || len(fields) != 1 {
+			return nil, fmt.Errorf("bad ipv6 address %q", fields[0])
+		}
+		return ip.To16(), nil
+	case type_ns, type_cname, type_ptr, type_alias:
+		if len(fields) != 1 {
+			return nil, errors.New("expected a single domain name")
+		}
+		return encodeName(fields[0])
+	case type_txt, type_hinfo:
+		if t == type_hinfo && len(fields) != 2 {
+			return nil, errors.New("hinfo needs cpu and os")
+		}
+		var out []byte
+		for _, s := range fields {
+			s = unquoteTXT(s)
+			if len(s) > 255 {
+				return nil, errors.New("txt string longer than 255 bytes")
+			}
+			out = append(out, byte(len(s)))
+			out = append(out, s...)
+		}
+		return out, nil
+	case type_mx:
+		if len(fields) != 2 {
+			return nil, errors.New("mx needs preference and exchange")
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad mx preference %q", fields[0])
+		}
+		exchange, err := encodeName(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return append(binary.BigEndian.AppendUint16(nil, uint16(preference)), exchange...), nil
+	case type_soa:
+		// SOA: <mname> <rname> <serial> <refresh> <retry> <expire> <minimum>
+		if len(fields) != 7 {
+			return nil, errors.New("soa needs mname rname serial refresh retry expire minimum")
+		}
+		mname, err := encodeName(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rname, err := encodeName(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		out := append(mname, rname...)
+		for _, f := range fields[2:] {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad soa number %q", f)
+			}
+			out = binary.BigEndian.AppendUint32(out, uint32(v))
+		}
+		return out, nil
+	case type_svcb, type_https:
+		return parseSVCB(fields)
+	case type_tlsa:
+		// TLSA: <usage> <selector> <matching type> <hex data>
+		if len(fields) < 4 {
+			return nil, errors.New("tlsa needs usage, selector, matching type and data")
+		}
+		var out []byte
+		for _, f := range fields[:3] {
+			v, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad tlsa field %q", f)
+			}
+			out = append(out, byte(v))
+		}
+		data, err := parseHexDigest(fields[3:], tlsaDigestLen(out[2]))
+		if err != nil {
+			return nil, err
+		}
+		return append(out, data...), nil
+	case type_sshfp:
+		// SSHFP: <algorithm> <fp type> <hex fingerprint>
+		if len(fields) < 3 {
+			return nil, errors.New("sshfp needs algorithm, fingerprint type and fingerprint")
+		}
+		algo, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil || algo == 0 {
+			return nil, fmt.Errorf("bad sshfp algorithm %q", fields[0])
+		}
+		fpType, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil || fpType == 0 {
+			return nil, fmt.Errorf("bad sshfp fingerprint type %q", fields[1])
+		}
+		fp, err := parseHexDigest(fields[2:], sshfpDigestLen(byte(fpType)))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{byte(algo), byte(fpType)}, fp...), nil
+	case type_naptr:
+		// NAPTR: <order> <preference> "<flags>" "<services>" "<regexp>" <replacement>
+		if len(fields) != 6 {
+			return nil, errors.New("naptr needs order, preference, flags, services, regexp and replacement")
+		}
+		var out []byte
+		for _, f := range fields[:2] {
+			v, err := strconv.ParseUint(f, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad naptr number %q", f)
+			}
+			out = binary.BigEndian.AppendUint16(out, uint16(v))
+		}
+		for _, s := range fields[2:5] {
+			if len(s) > 255 {
+				return nil, errors.New("naptr string longer than 255 bytes")
+			}
+			out = append(out, byte(len(s)))
+			out = append(out, s...)
+		}
+		replacement, err := encodeName(fields[5])
+		if err != nil {
+			return nil, err
+		}
+		return append(out, replacement...), nil
+	case type_uri:
+		// URI: <priority> <weight> "<target>"
+		if len(fields) != 3 || fields[2] == "" {
+			return nil, errors.New("uri needs priority, weight and target")
+		}
+		var out []byte
+		for _, f := range fields[:2] {
+			v, err := strconv.ParseUint(f, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad uri number %q", f)
+			}
+			out = binary.BigEndian.AppendUint16(out, uint16(v))
+		}
+		return append(out, fields[2]...), nil
+	case type_loc:
+		return parseLOC(fields)
+	case type_srv:
+		// SRV: <priority> <weight> <port> <target>
+		if len(fields) != 4 {
+			return nil, errors.New("srv needs priority, weight, port and target")
+		}
+		var out []byte
+		for _, f := range fields[:3] {
+			v, err := strconv.ParseUint(f, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad srv number %q", f)
+			}
+			out = binary.BigEndian.AppendUint16(out, uint16(v))
+		}
+		target, err := encodeName(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		return append(out, target...), nil
+	}
+	return nil, fmt.Errorf("no presentation format for %s, use the \\# syntax", typeToString(t))
+}
+
+// tlsaDigestLen is the data length a TLSA matching type requires (0 = any)
+func tlsaDigestLen(matchingType byte) int {
+	switch matchingType {
+	case 1: // SHA-256
+		return 32
+	case 2: // SHA-512
+		return 64
+	}
+	return 0
+}
+
+// sshfpDigestLen is the fingerprint length an SSHFP fingerprint type requires (0 = any)
+func sshfpDigestLen(fpType byte) int {
+	switch fpType {
+	case 1: // SHA-1
+		return 20
+	case 2: // SHA-256
+		return 32
+	}
+	return 0
+}
+
+// parseHexDigest joins hex fields (they may be split by whitespace) and checks the length
+func parseHexDigest(fields []string, want int) ([]byte, error) {
+	data, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, fmt.Errorf("bad hex data: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty hex data")
+	}
+	if want != 0 && len(data) != want {
+		return nil, fmt.Errorf("hex data is %d bytes, digest type needs %d", len(data), want)
+	}
+	return data, nil
+}
+
+// parseGenericRdata parses "<length> <hex>..." (RFC 3597 section 5)
+func parseGenericRdata(t uint16, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return nil, errors.New(`\# needs a length`)
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`bad \# length %q`, fields[0])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf(`bad \# hex data: %v`, err)
+	}
+	if len(data) != int(n) {
+		return nil, fmt.Errorf(`\# length %d does not match %d bytes of data`, n, len(data))
+	}
+	// a known type has to be valid rdata of that type: formatRdata only falls
+	// back to the generic form for rdata it can't decode
+	if _, known := typeNames[t]; known && strings.HasPrefix(formatRdata(t, data), `\#`) {
+		return nil, fmt.Errorf(`\# data is not valid %s rdata`, typeToString(t))
+	}
+	return data, nil
+}
+
+// formatRdata is the reverse of parseRdata. rdata we can't decode is written
+// in the generic form so it always survives a save/load round trip
+func formatRdata(t uint16, rdata []byte) string {
+	switch t {
+	case type_a:
+		if len(rdata) == 4 {
+			return net.IP(rdata).String()
+		}
+	case type_aaaa:
+		if len(rdata) == 16 {
+			return net.IP(rdata).String()
+		}
+	case type_ns, type_cname, type_ptr, type_alias:
+		if name, off, err := readRdataName(rdata, 0); err == nil && off == len(rdata) {
+			return name
+		}
+	case type_txt, type_hinfo:
+		var parts []string
+		for i := 0; i < len(rdata); {
+			sz := int(rdata[i])
+			if i+1+sz > len(rdata) {
+				parts = nil
+				break
+			}
+			parts = append(parts, quoteTXT(string(rdata[i+1:i+1+sz])))
+			i += 1 + sz
+		}
+		if parts != nil && (t == type_txt || len(parts) == 2) {
+			return strings.Join(parts, " ")
+		}
+	case type_mx:
+		if len(rdata) > 2 {
+			if name, off, err := readRdataName(rdata, 2); err == nil && off == len(rdata) {
+				return strconv.Itoa(int(binary.BigEndian.Uint16(rdata))) + " " + name
+			}
+		}
+	case type_soa:
+		if soa := parseSOARdata(rdata); soa != nil {
+			return soa.MName + " " + soa.RName + " " +
+				strconv.FormatUint(uint64(soa.Serial), 10) + " " +
+				strconv.FormatUint(uint64(soa.Refresh), 10) + " " +
+				strconv.FormatUint(uint64(soa.Retry), 10) + " " +
+				strconv.FormatUint(uint64(soa.Expire), 10) + " " +
+				strconv.FormatUint(uint64(soa.Minimum), 10)
+		}
+	case type_svcb, type_https:
+		if s, err := formatSVCB(rdata); err == nil {
+			return s
+		}
+	case type_tlsa:
+		if len(rdata) > 3 && (tlsaDigestLen(rdata[2]) == 0 || tlsaDigestLen(rdata[2]) == len(rdata)-3) {
+			return strconv.Itoa(int(rdata[0])) + " " + strconv.Itoa(int(rdata[1])) + " " +
+				strconv.Itoa(int(rdata[2])) + " " + strings.ToUpper(hex.EncodeToString(rdata[3:]))
+		}
+	case type_naptr:
+		if s, ok := formatNAPTR(rdata); ok {
+			return s
+		}
+	case type_uri:
+		if len(rdata) > 4 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(rdata))) + " " +
+				strconv.Itoa(int(binary.BigEndian.Uint16(rdata[2:]))) + " " + quoteTXT(string(rdata[4:]))
+		}
+	case type_loc:
+		if s, err := formatLOC(rdata); err == nil {
+			return s
+		}
+	case type_srv:
+		if len(rdata) > 6 {
+			if name, off, err := readRdataName(rdata, 6); err == nil && off == len(rdata) {
+				return strconv.Itoa(int(binary.BigEndian.Uint16(rdata))) + " " +
+					strconv.Itoa(int(binary.BigEndian.Uint16(rdata[2:]))) + " " +
+					strconv.Itoa(int(binary.BigEndian.Uint16(rdata[4:]))) + " " + name
+			}
+		}
+	case type_sshfp:
+		if len(rdata) > 2 && rdata[0] != 0 && rdata[1] != 0 && (sshfpDigestLen(rdata[1]) == 0 || sshfpDigestLen(rdata[1]) == len(rdata)-2) {
+			return strconv.Itoa(int(rdata[0])) + " " + strconv.Itoa(int(rdata[1])) + " " +
+				strings.ToUpper(hex.EncodeToString(rdata[2:]))
+		}
+	}
+	return formatGenericRdata(rdata)
+}
+
+// formatNAPTR decodes naptr rdata: two numbers, three character-strings and a name
+func formatNAPTR(rdata []byte) (string, bool) {
+	if len(rdata) < 4 {
+		return "", false
+	}
+	parts := []string{strconv.Itoa(int(binary.BigEndian.Uint16(rdata))), strconv.Itoa(int(binary.BigEndian.Uint16(rdata[2:])))}
+	off := 4
+	for i := 0; i < 3; i++ {
+		if off >= len(rdata) || off+1+int(rdata[off]) > len(rdata) {
+			return "", false
+		}
+		parts = append(parts, quoteTXT(string(rdata[off+1:off+1+int(rdata[off])])))
+		off += 1 + int(rdata[off])
+	}
+	replacement, off, err := readRdataName(rdata, off)
+	if err != nil || off != len(rdata) {
+		return "", false
+	}
+	return strings.Join(append(parts, replacement), " "), true
+}
+
+// formatGenericRdata writes rdata as \# <length> <hex>
+func formatGenericRdata(rdata []byte) string {
+	if len(rdata) == 0 {
+		return `\# 0`
+	}
+	return `\# ` + strconv.Itoa(len(rdata)) + " " + hex.EncodeToString(rdata)
+}
+
+// parseSOARdata is a checked version of decode_soa_rdata
+func parseSOARdata(rdata []byte) *soaRdata {
+	mname, off, err := readRdataName(rdata, 0)
+	if err != nil {
+		return nil
+	}
+	rname, off, err := readRdataName(rdata, off)
+	if err != nil || len(rdata) != off+20 {
+		return nil
+	}
+	return &soaRdata{
+		MName:   mname,
+		RName:   rname,
+		Serial:  binary.BigEndian.Uint32(rdata[off:]),
+		Refresh: binary.BigEndian.Uint32(rdata[off+4:]),
+		Retry:   binary.BigEndian.Uint32(rdata[off+8:]),
+		Expire:  binary.BigEndian.Uint32(rdata[off+12:]),
+		Minimum: binary.BigEndian.Uint32(rdata[off+16:]),
+	}
+}
+
+// makeRR builds a record from wire rdata and fills in the convenience fields
+func makeRR(name string, t uint16, ttl uint32, rdata []byte) rr {
+	r := rr{Name: name, Type_: t, Class: class_in, TTL: ttl, Rdata: rdata}
+	switch t {
+	case type_soa:
+		r.SOA = parseSOARdata(rdata)
+	case type_mx:
+		if len(rdata) > 2 {
+			if exchange, _, err := readRdataName(rdata, 2); err == nil {
+				r.Preference = binary.BigEndian.Uint16(rdata)
+				r.Exchange = exchange
+			}
+		}
+	}
+	return r
+}
+
+// parseRecord parses a "<name> <type> <rdata...> <ttl>" zone file line (without
+// its comment) into a record
+func parseRecord(line string) (rr, error) {
+	parts, quoted := zoneFields(line)
+	if len(parts) < 4 {
+		return rr{}, errors.New("expected name, type, data and ttl")
+	}
+	t, ok := stringToType(parts[1])
+	if !ok {
+		return rr{}, fmt.Errorf("unknown record type %q", parts[1])
+	}
+	ttl, err := strconv.ParseUint(parts[len(parts)-1], 10, 32)
+	if err != nil {
+		return rr{}, fmt.Errorf("bad ttl %q", parts[len(parts)-1])
+	}
+	rdata, err := parseTextRdata(t, parts[2:len(parts)-1], quoted[2:len(parts)-1])
+	if err != nil {
+		return rr{}, err
+	}
+	return makeRR(fqdn(strings.ToLower(parts[0])), t, uint32(ttl), rdata), nil
+}
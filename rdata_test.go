@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenericRdataRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "zone.txt")
+	os.WriteFile(path, []byte(`# zone TYPE data TTL
+example.com. SOA ns1.example.com. hostmaster.example.com. 2024010101 3600 1800 604800 600 3600
+example.com. MX 10 mail.example.com. 300
+example.com. TXT "hello world" "second string" 300
+example.com. TYPE65280 \# 4 0A000001 300
+example.com. A \# 4 C0000201 300
+empty.example.com. TYPE65281 \# 0 300
+hash.example.com. TXT "#" "x" 300
+hash.example.com. TXT "\\#" "4" "00" 300
+`), 0644)
+
+	zone = newZoneTree()
+	if err := load_zone(zone, path); err != nil {
+		t.Fatal(err)
+	}
+	before := zone.get("example.com.")
+	if len(before) != 5 || len(zone.get("empty.example.com.")) != 1 {
+		t.Fatalf("expected 6 records, got %+v", zone)
+	}
+	if got := formatRdata(before[3].Type_, before[3].Rdata); got != `\# 4 0a000001` {
+		t.Errorf("unknown type formatted as %q", got)
+	}
+	if before[4].Type_ != type_a || formatRdata(before[4].Type_, before[4].Rdata) != "192.0.2.1" {
+		t.Errorf("generic A record not decoded: %+v", before[4])
+	}
+	if before[0].SOA == nil || before[0].SOA.Serial != 2024010101 || before[0].TTL != 3600 {
+		t.Errorf("SOA not parsed: %+v", before[0])
+	}
+	if before[1].Preference != 10 || before[1].Exchange != "mail.example.com." {
+		t.Errorf("MX not parsed: %+v", before[1])
+	}
+
+	if err := save_zone(zone, path); err != nil {
+		t.Fatal(err)
+	}
+	zone = newZoneTree()
+	if err := load_zone(zone, path); err != nil {
+		t.Fatal(err)
+	}
+	after := zone.get("example.com.")
+	if len(after) != len(before) {
+		t.Fatalf("round trip lost records: %d -> %d", len(before), len(after))
+	}
+	for i := range before {
+		if after[i].Type_ != before[i].Type_ || after[i].TTL != before[i].TTL || !bytes.Equal(after[i].Rdata, before[i].Rdata) {
+			t.Errorf("record %d changed: %+v -> %+v", i, before[i], after[i])
+		}
+	}
+	if recs := zone.get("empty.example.com."); len(recs) != 1 || len(recs[0].Rdata) != 0 || recs[0].Type_ != 65281 {
+		t.Errorf("empty generic record lost: %+v", recs)
+	}
+	// a quoted "#" or "\#" is text, only an unquoted \# is the generic marker
+	hash := zone.get("hash.example.com.")
+	if len(hash) != 2 || formatRdata(type_txt, hash[0].Rdata) != `"#" "x"` || formatRdata(type_txt, hash[1].Rdata) != `"\\#" "4" "00"` {
+		t.Errorf("TXT starting with # after a round trip: %+v", hash)
+	}
+}
+
+func TestParseRdataErrors(t *testing.T) {
+	cases := []struct {
+		t      uint16
+		fields []string
+	}{
+		{type_a, []string{"not-an-ip"}},
+		{type_aaaa, []string{"192.0.2.1"}},
+		{65280, []string{"0a000001"}},
+		{65280, []string{`\#`, "3", "0a000001"}},
+		{65280, []string{`\#`, "4", "zz"}},
+		{type_a, []string{`\#`, "3", "c00002"}},
+		{type_mx, []string{`\#`, "2", "000a"}},
+		{type_mx, []string{"mail.example.com."}},
+	}
+	for _, c := range cases {
+		if _, err := parseRdata(c.t, c.fields); err == nil {
+			t.Errorf("expected error for %s %v", typeToString(c.t), c.fields)
+		}
+	}
+}
+
+func TestSVCBRdata(t *testing.T) {
+	valid := []string{
+		"0 svc.example.com.",
+		"1 .",
+		"16 foo.example.org. alpn=h2,h3-19 mandatory=alpn,ipv4hint ipv4hint=192.0.2.1",
+		"1 foo.example.com. port=53",
+		"1 . alpn=h3 no-default-alpn ipv6hint=2001:db8::1,2001:db8::53:1 ech=AEP+DQA/",
+		"2 . key667=hello",
+	}
+	for _, v := range valid {
+		rdata, err := parseRdata(type_https, parseZoneLine(v))
+		if err != nil {
+			t.Errorf("%q: %v", v, err)
+			continue
+		}
+		out := formatRdata(type_https, rdata)
+		again, err := parseRdata(type_https, parseZoneLine(out))
+		if err != nil || !bytes.Equal(again, rdata) {
+			t.Errorf("%q formatted as %q which does not round trip (%v)", v, out, err)
+		}
+	}
+
+	// RFC 9460 appendix D.2 vector: params are sorted on the wire
+	rdata, _ := parseRdata(type_svcb, parseZoneLine(`16 foo.example.org. alpn="h2,h3-19" mandatory=ipv4hint,alpn ipv4hint=192.0.2.1`))
+	want := []byte{
+		0x00, 0x10, 0x03, 'f', 'o', 'o', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'o', 'r', 'g', 0x00,
+		0x00, 0x00, 0x00, 0x04, 0x00, 0x01, 0x00, 0x04,
+		0x00, 0x01, 0x00, 0x09, 0x02, 'h', '2', 0x05, 'h', '3', '-', '1', '9',
+		0x00, 0x04, 0x00, 0x04, 0xc0, 0x00, 0x02, 0x01,
+	}
+	if !bytes.Equal(rdata, want) {
+		t.Errorf("wire format mismatch:\n got %x\nwant %x", rdata, want)
+	}
+
+	invalid := []string{
+		"0 . alpn=h2",
+		"1 . alpn=h2 alpn=h3",
+		"1 . mandatory=port",
+		"1 . mandatory=mandatory,alpn alpn=h2",
+		"1 . no-default-alpn",
+		"1 . port=70000",
+		"1 . ipv4hint=2001:db8::1",
+		"1 . ipv6hint=192.0.2.1",
+		"1 . ech=!!!",
+		"1 . bogus=1",
+		"1 . port",
+	}
+	for _, v := range invalid {
+		if _, err := parseRdata(type_svcb, parseZoneLine(v)); err == nil {
+			t.Errorf("%q should be rejected", v)
+		}
+	}
+}
+
+func TestTLSAAndSSHFPRdata(t *testing.T) {
+	sha256 := "0C72AC70B745AC19998811B131D662C9AC69DBDBE7CB23E5B514B56664C5D3D6"
+	rdata, err := parseRdata(type_tlsa, []string{"3", "1", "1", sha256[:32], sha256[32:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatRdata(type_tlsa, rdata); got != "3 1 1 "+sha256 {
+		t.Errorf("tlsa formatted as %q", got)
+	}
+	if _, err := parseRdata(type_tlsa, []string{"3", "1", "2", sha256}); err == nil {
+		t.Error("sha-512 matching type with a 32 byte digest should be rejected")
+	}
+	if _, err := parseRdata(type_tlsa, []string{"3", "0", "0", "3082"}); err != nil {
+		t.Errorf("full certificate data of any length should be accepted: %v", err)
+	}
+
+	rdata, err = parseRdata(type_sshfp, []string{"4", "2", sha256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatRdata(type_sshfp, rdata); got != "4 2 "+sha256 {
+		t.Errorf("sshfp formatted as %q", got)
+	}
+	if _, err := parseRdata(type_sshfp, []string{"4", "1", sha256}); err == nil {
+		t.Error("sha-1 fingerprint type with a 32 byte digest should be rejected")
+	}
+	if _, err := parseRdata(type_sshfp, []string{"4", "2", "xyz"}); err == nil {
+		t.Error("non-hex fingerprint should be rejected")
+	}
+	// a wrong length from the wire falls back to the generic form
+	if got := formatRdata(type_sshfp, []byte{4, 1, 0xab}); got != `\# 3 0401ab` {
+		t.Errorf("bad sshfp rdata formatted as %q", got)
+	}
+}
+
+func TestNAPTRURIAndLOCRdata(t *testing.T) {
+	cases := []struct {
+		t    uint16
+		in   string
+		want string
+	}{
+		{type_naptr, `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`, `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`},
+		{type_naptr, `100 50 "u" "E2U+sip" "!^.*$!sip:info@example.com!" .`, `100 50 "u" "E2U+sip" "!^.*$!sip:info@example.com!" .`},
+		{type_uri, `10 1 "ftp://ftp1.example.com/public"`, `10 1 "ftp://ftp1.example.com/public"`},
+		// RFC 1876 examples
+		{type_loc, `42 21 54 N 71 06 18 W -24m 30m`, `42 21 54.000 N 71 6 18.000 W -24.00m 30.00m 10000.00m 10.00m`},
+		{type_loc, `42 21 43.952 N 71 5 6.344 W -24m 1m 200m`, `42 21 43.952 N 71 5 6.344 W -24.00m 1.00m 200.00m 10.00m`},
+		{type_loc, `52 N 4 E 0`, `52 0 0.000 N 4 0 0.000 E 0.00m 1.00m 10000.00m 10.00m`},
+		{type_loc, `33 51 20.5 S 151 12 55.05 E 58.5m 1m 10m 2m`, `33 51 20.500 S 151 12 55.050 E 58.50m 1.00m 10.00m 2.00m`},
+	}
+	for _, c := range cases {
+		rdata, err := parseRdata(c.t, parseZoneLine(c.in))
+		if err != nil {
+			t.Errorf("%s %q: %v", typeToString(c.t), c.in, err)
+			continue
+		}
+		if got := formatRdata(c.t, rdata); got != c.want {
+			t.Errorf("%s %q formatted as %q, want %q", typeToString(c.t), c.in, got, c.want)
+		}
+	}
+
+	rdata, _ := parseRdata(type_loc, parseZoneLine(`42 21 54 N 71 06 18 W -24m 30m`))
+	want := []byte{0x00, 0x33, 0x16, 0x13, 0x89, 0x17, 0x2d, 0xd0, 0x70, 0xbe, 0x15, 0xf0, 0x00, 0x98, 0x8d, 0x20}
+	if !bytes.Equal(rdata, want) {
+		t.Errorf("loc wire format:\n got %x\nwant %x", rdata, want)
+	}
+
+	invalid := []struct {
+		t  uint16
+		in string
+	}{
+		{type_naptr, `100 10 "S" "SIP+D2U" _sip._udp.example.com.`},
+		{type_uri, `10 1 ""`},
+		{type_loc, `91 N 0 E 0m`},
+		{type_loc, `45 60 N 0 E 0m`},
+		{type_loc, `45 N 181 W 0m`},
+		{type_loc, `45 N 10 E`},
+		{type_loc, `45 N 10 E -100001m`},
+		{type_loc, `45 N 10 E 0m 1m 1m 1m 1m`},
+	}
+	for _, c := range invalid {
+		if _, err := parseRdata(c.t, parseZoneLine(c.in)); err == nil {
+			t.Errorf("%s %q should be rejected", typeToString(c.t), c.in)
+		}
+	}
+}
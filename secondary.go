@@ -0,0 +1,615 @@
+// secondary zones: copies of zones kept up to date by transferring them from
+// their primary (RFC 1034 section 4.3.5, RFC 1995, RFC 1996, RFC 5936)
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secondaryZone is a zone we serve from transfers of the primary's copy
+type secondaryZone struct {
+	Zone    string // apex, eg "example.com."
+	Primary string // "host:port" of the primary, port 53 when left out
+	KeyName string // TSIG key (from setupAXFR) for transfers, "" for unsigned
+	File    string // the zone is saved here after every transfer and loaded from it at startup
+	View    string // view the zone is served in, "" when there are no views
+	Catalog bool   // the zone is a catalog (RFC 9432): its members become secondary zones too, see catalog.go
+
+	member string // for a member zone, the catalog it came from
+	tree   *zoneTree
+	notify chan struct{} // a NOTIFY from the primary: check now
+	stop   chan struct{} // closed when the zone is no longer configured
+	// held through a refresh, so the zone can be removed once the refresh in
+	// progress is done
+	refreshing *sync.Mutex
+
+	// the rest is guarded by secondaryMu
+	serial    uint32
+	loaded    bool      // we have a copy of the zone, maybe expired
+	expired   bool      // the primary was unreachable past the SOA expire time
+	expires   time.Time // when the copy expires unless the primary answers before
+	refreshed time.Time // when the primary last answered
+	err       string    // what went wrong with the last refresh
+}
+
+// configured secondary zones
+var secondaries []*secondaryZone
+var secondaryMu sync.Mutex
+
+// wait before retrying when there is no SOA to take the retry time from
+var secondaryRetry = time.Minute
+
+// how long one exchange with the primary may take
+var secondaryTimeout = 30 * time.Second
+
+// secondary zones config (to call while dns startup, after setupViews). every
+// zone is loaded from its file if there is one; startSecondaries keeps them
+// up to date. calling it again replaces the previous config
+func setupSecondaries(zs ...secondaryZone) error {
+	var out []*secondaryZone
+	for _, s := range zs {
+		sz, err := newSecondary(s)
+		if err != nil {
+			return err
+		}
+		out = append(out, sz)
+	}
+	secondaryMu.Lock()
+	for _, s := range secondaries {
+		close(s.stop)
+	}
+	secondaries = out
+	secondariesRunning = false
+	secondaryMu.Unlock()
+	for _, s := range out {
+		if s.Catalog && s.serving() {
+			s.syncCatalog()
+		}
+	}
+	return nil
+}
+
+// newSecondary checks the config of a secondary zone and loads its saved copy
+func newSecondary(s secondaryZone) (*secondaryZone, error) {
+	if s.Zone == "" || s.Primary == "" || s.File == "" {
+		return nil, errors.New("secondary zone needs a zone, a primary and a file")
+	}
+	s.Zone = fqdn(strings.ToLower(s.Zone))
+	if _, _, err := net.SplitHostPort(s.Primary); err != nil {
+		s.Primary = net.JoinHostPort(s.Primary, "53")
+	}
+	if s.KeyName != "" && getTSIGKey(s.KeyName) == nil {
+		return nil, fmt.Errorf("secondary %s: unknown TSIG key %s", s.Zone, s.KeyName)
+	}
+	v, err := configuredView(s.View)
+	if err != nil {
+		return nil, fmt.Errorf("secondary %s: %v", s.Zone, err)
+	}
+	s.tree = v.zone
+	s.notify = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.refreshing = &sync.Mutex{}
+	if err := s.loadFile(); err != nil && !os.IsNotExist(err) {
+		log.Printf("secondary %s: could not load %s: %v", s.Zone, s.File, err)
+	}
+	return &s, nil
+}
+
+// set by startSecondaries, so zones added later (catalog members) start too
+var secondariesRunning bool
+
+// startSecondaries refreshes every secondary zone in the background
+func startSecondaries() {
+	secondaryMu.Lock()
+	defer secondaryMu.Unlock()
+	secondariesRunning = true
+	for _, s := range secondaries {
+		go s.run()
+	}
+}
+
+// secondaryFor returns the secondary zone of z that name is in, nil when it
+// is in none
+func secondaryFor(z *zoneTree, name string) *secondaryZone {
+	secondaryMu.Lock()
+	defer secondaryMu.Unlock()
+	var found *secondaryZone
+	for _, s := range secondaries {
+		if s.tree == z && isBelow(name, s.Zone) && (found == nil || isBelow(s.Zone, found.Zone)) {
+			found = s
+		}
+	}
+	return found
+}
+
+// serving reports whether the zone can be answered from: not before the
+// first transfer and not after it expired
+func (s *secondaryZone) serving() bool {
+	secondaryMu.Lock()
+	defer secondaryMu.Unlock()
+	return s.loaded && !s.expired
+}
+
+// loadFile serves the copy saved by an earlier run. it expires the SOA expire
+// time after the file was written
+func (s *secondaryZone) loadFile() error {
+	info, err := os.Stat(s.File)
+	if err != nil {
+		return err
+	}
+	tmp := newZoneTree()
+	if err := load_zone(tmp, s.File); err != nil {
+		return err
+	}
+	records := tmp.snapshot(s.Zone)
+	if len(records) == 0 || records[0].SOA == nil {
+		return errors.New("no SOA for " + s.Zone)
+	}
+	soa := records[0].SOA
+	expires := info.ModTime().Add(time.Duration(soa.Expire) * time.Second)
+	if time.Now().After(expires) {
+		return errors.New("saved copy has expired")
+	}
+	s.tree.replaceZone(s.Zone, records)
+	secondaryMu.Lock()
+	s.serial, s.loaded, s.expires = soa.Serial, true, expires
+	secondaryMu.Unlock()
+	return nil
+}
+
+// run refreshes the zone whenever the SOA timers or a NOTIFY say so
+func (s *secondaryZone) run() {
+	for {
+		wait := s.refresh(time.Now())
+		select {
+		case <-s.notify:
+		case <-time.After(wait):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// refresh asks the primary for its serial and transfers the zone when it has
+// a newer one. it returns how long to wait until the next refresh: the SOA
+// refresh time after a success, the retry time after a failure. a copy the
+// primary hasn't answered for since the expire time is no longer served
+func (s *secondaryZone) refresh(now time.Time) time.Duration {
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+	select {
+	case <-s.stop:
+		// removed, nothing may be installed for it anymore
+		return secondaryRetry
+	default:
+	}
+	secondaryMu.Lock()
+	serial, loaded := s.serial, s.loaded && !s.expired
+	secondaryMu.Unlock()
+
+	primary, err := s.primarySerial()
+	if err == nil && (!loaded || serialLess(serial, primary)) {
+		err = s.transfer(loaded, serial)
+	}
+	if err == nil && s.Catalog {
+		s.syncCatalog()
+	}
+
+	soa, hasSOA := s.soa()
+	secondaryMu.Lock()
+	defer secondaryMu.Unlock()
+	s.err = ""
+	if err != nil {
+		s.err = err.Error()
+		log.Printf("secondary %s: refresh from %s: %v", s.Zone, s.Primary, err)
+	} else if hasSOA {
+		s.serial, s.loaded, s.expired = soa.Serial, true, false
+		s.refreshed = now
+		s.expires = now.Add(time.Duration(soa.Expire) * time.Second)
+	}
+	if s.loaded && !s.expired && !now.Before(s.expires) {
+		log.Printf("secondary %s: expired, primary %s unreachable since %s", s.Zone, s.Primary, s.refreshed.Format(time.RFC3339))
+		s.expired = true
+		s.tree.replaceZone(s.Zone, nil)
+	}
+	if !hasSOA || s.expired {
+		return secondaryRetry
+	}
+	wait := time.Duration(soa.Refresh) * time.Second
+	if err != nil {
+		wait = time.Duration(soa.Retry) * time.Second
+	}
+	if left := s.expires.Sub(now); !s.expired && left < wait {
+		wait = left
+	}
+	return max(wait, time.Second)
+}
+
+// soa is the SOA of our copy
+func (s *secondaryZone) soa() (*soaRdata, bool) {
+	for _, r := range s.tree.get(s.Zone) {
+		if r.Type_ == type_soa && r.SOA != nil {
+			return r.SOA, true
+		}
+	}
+	return nil, false
+}
+
+// primarySerial asks the primary for the SOA serial of the zone
+func (s *secondaryZone) primarySerial() (uint32, error) {
+	answers, err := s.exchange(type_soa, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range answers {
+		if r.Type_ == type_soa && r.Name == s.Zone && r.SOA != nil {
+			return r.SOA.Serial, nil
+		}
+	}
+	return 0, errors.New("primary has no SOA for the zone")
+}
+
+// transfer gets the zone from the primary: by IXFR when we have a copy to
+// apply the differences to, otherwise (or when the primary answers IXFR with
+// the whole zone) by AXFR. the result is saved to the zone's file
+func (s *secondaryZone) transfer(incremental bool, serial uint32) error {
+	var answers []rr
+	var err error
+	if incremental {
+		var soa []rr
+		for _, r := range s.tree.get(s.Zone) {
+			if r.Type_ == type_soa {
+				soa = append(soa, r)
+			}
+		}
+		answers, err = s.exchange(251, soa)
+	} else {
+		answers, err = s.exchange(252, nil)
+	}
+	if err != nil {
+		return err
+	}
+	// a primary only hands out its own zone's records, anything else would
+	// end up in our other zones (RFC 5936 section 3.2)
+	for _, r := range answers {
+		if !isBelow(r.Name, s.Zone) {
+			return errors.New("transfer has " + r.Name + ", outside the zone")
+		}
+	}
+	first := answers[0]
+	switch {
+	case len(answers) == 1:
+		// IXFR: nothing changed after all
+	case incremental && isIncremental(answers):
+		deltas, err := ixfrDeltas(answers, serial)
+		if err != nil {
+			return err
+		}
+		for _, d := range deltas {
+			s.tree.change(s.Zone, append(d.Deleted, d.From), append(d.Added, d.To))
+		}
+		log.Printf("secondary %s: IXFR from %s, serial %d -> %d in %d changes", s.Zone, s.Primary, serial, first.SOA.Serial, len(deltas))
+	default:
+		records := answers[:len(answers)-1]
+		s.tree.replaceZone(s.Zone, records)
+		notifyZone(s.Zone, first.SOA.Serial)
+		log.Printf("secondary %s: AXFR from %s, serial %d, %d records", s.Zone, s.Primary, first.SOA.Serial, len(records))
+	}
+	return saveRecords(s.File, s.tree.snapshot(s.Zone))
+}
+
+// ixfrDeltas splits an incremental IXFR answer into its changes (RFC 1995
+// section 4): the new SOA, then old SOA, deletions, new SOA, additions for
+// every change, then the new SOA again. the first change has to start at
+// serial, each following one where the last one ended
+func ixfrDeltas(answers []rr, serial uint32) ([]zoneDelta, error) {
+	recs := answers[1 : len(answers)-1]
+	var deltas []zoneDelta
+	for i := 0; i < len(recs); {
+		d := zoneDelta{From: recs[i]}
+		if d.From.SOA == nil || d.From.SOA.Serial != serial {
+			return nil, errors.New("IXFR changes don't start at serial " + strconv.FormatUint(uint64(serial), 10))
+		}
+		for i++; i < len(recs) && recs[i].Type_ != type_soa; i++ {
+			d.Deleted = append(d.Deleted, recs[i])
+		}
+		if i == len(recs) {
+			return nil, errors.New("IXFR change without a new SOA")
+		}
+		d.To = recs[i]
+		for i++; i < len(recs) && recs[i].Type_ != type_soa; i++ {
+			d.Added = append(d.Added, recs[i])
+		}
+		serial = d.To.SOA.Serial
+		deltas = append(deltas, d)
+	}
+	if serial != answers[0].SOA.Serial {
+		return nil, errors.New("IXFR changes don't end at the new serial")
+	}
+	return deltas, nil
+}
+
+// exchange sends one query for the zone to the primary over tcp and returns
+// the answer records of the response, all of its messages for a transfer.
+// authority goes in the authority section (the client's SOA for IXFR)
+func (s *secondaryZone) exchange(qtype uint16, authority []rr) ([]rr, error) {
+	conn, err := net.DialTimeout("tcp", s.Primary, secondaryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(secondaryTimeout))
+
+	id := uint16(rand.Intn(1 << 16))
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, dns_header{Id: id, Qdcount: 1, Nscount: uint16(len(authority))})
+	write_name(buf, s.Zone)
+	binary.Write(buf, binary.BigEndian, qtype)
+	binary.Write(buf, binary.BigEndian, uint16(class_in))
+	for _, r := range authority {
+		write_rr(buf, r)
+	}
+	msg := buf.Bytes()
+	verifier := &tsigVerifier{}
+	// only transfers are signed: a wrong serial from a forged SOA answer
+	// costs a transfer at worst, and the transfer itself is checked
+	if s.KeyName != "" && (qtype == 252 || qtype == 251) {
+		key := getTSIGKey(s.KeyName)
+		if key == nil {
+			return nil, errors.New("unknown TSIG key " + s.KeyName)
+		}
+		if !keyAllows(key, keyUseTransfer) {
+			return nil, errors.New("key " + key.Name + " may not be used for transfers")
+		}
+		t := &tsigRecord{
+			Name:       fqdn(key.Name),
+			Algorithm:  fqdn(key.Algorithm),
+			TimeSigned: uint64(time.Now().Unix()),
+			Fudge:      300,
+			OrigID:     id,
+		}
+		if msg, err = signTSIG(msg, key, nil, t, false); err != nil {
+			return nil, err
+		}
+		verifier = &tsigVerifier{key: key, prior: t.MAC}
+	}
+	if err := write_tcp_msg(conn, msg); err != nil {
+		return nil, err
+	}
+
+	var answers []rr
+	for {
+		raw, err := read_tcp_msg(conn)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := parse_full_msg(raw)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Hdr.Id != id || resp.Hdr.Flags&qr_mask == 0 {
+			return nil, errors.New("response doesn't match the query")
+		}
+		if err := verifier.verify(raw, time.Now()); err != nil {
+			return nil, err
+		}
+		if rcode := resp.Hdr.Flags & rcode_mask; rcode != rcode_noerror {
+			return nil, errors.New("answered with rcode " + strconv.Itoa(int(rcode)))
+		}
+		for _, r := range resp.Answer {
+			answers = append(answers, makeRR(strings.ToLower(r.Name), r.Type_, r.TTL, r.Rdata))
+		}
+		if qtype != 252 && qtype != 251 {
+			return answers, verifier.done()
+		}
+		if len(answers) == 0 || answers[0].Type_ != type_soa || answers[0].Name != s.Zone {
+			return nil, errors.New("transfer doesn't start with the zone's SOA")
+		}
+		if transferDone(qtype, answers) {
+			return answers, verifier.done()
+		}
+	}
+}
+
+// transferDone reports whether answers holds a whole transfer: the first SOA
+// has come round again, twice for an incremental IXFR where it is also the
+// new SOA of the last change. an IXFR answered with just the SOA is up to date
+func transferDone(qtype uint16, answers []rr) bool {
+	if qtype == 251 && len(answers) == 1 {
+		return true
+	}
+	want := 2
+	if qtype == 251 && isIncremental(answers) {
+		want = 3
+	}
+	n := 0
+	for _, r := range answers {
+		if r.Type_ == type_soa && r.SOA != nil && r.SOA.Serial == answers[0].SOA.Serial {
+			n++
+		}
+	}
+	return n >= want
+}
+
+// isIncremental tells an incremental IXFR answer from one with the whole
+// zone: its second record is the SOA a change starts from, which is never the
+// new serial
+func isIncremental(answers []rr) bool {
+	return len(answers) > 1 && answers[1].Type_ == type_soa && answers[1].SOA != nil &&
+		answers[1].SOA.Serial != answers[0].SOA.Serial
+}
+
+// tsigVerifier checks the TSIGs of the messages of a response to a signed
+// request (RFC 8945 section 5.3.1). up to 99 messages in a row may be
+// unsigned, they are covered by the next signed one. nothing is checked
+// when there is no key
+type tsigVerifier struct {
+	key      *tsigKey
+	prior    []byte
+	signed   int
+	unsigned []byte // messages since the last signed one
+	pending  int
+}
+
+// verify checks the TSIG of the next message of the response
+func (v *tsigVerifier) verify(msg []byte, now time.Time) error {
+	if v.key == nil {
+		return nil
+	}
+	t, start, err := parseTSIG(msg)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		if v.signed == 0 || v.pending >= 99 {
+			return errors.New("response not signed")
+		}
+		v.unsigned = append(v.unsigned, msg...)
+		v.pending++
+		return nil
+	}
+	if t.Error != 0 {
+		return errors.New("TSIG error " + strconv.Itoa(int(t.Error)))
+	}
+	if !strings.EqualFold(t.Name, fqdn(v.key.Name)) || !strings.EqualFold(t.Algorithm, fqdn(v.key.Algorithm)) {
+		return errors.New("response signed with another key")
+	}
+	signed := append(v.unsigned, msg[:start]...)
+	body := signed[len(v.unsigned):]
+	binary.BigEndian.PutUint16(body, t.OrigID)
+	binary.BigEndian.PutUint16(body[10:], binary.BigEndian.Uint16(body[10:])-1)
+	mac, err := tsigMAC(v.key.Algorithm, v.key.Secret, tsigDigest(v.prior, signed, t, v.signed > 0))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(t.MAC, mac) {
+		return errors.New("bad TSIG on response")
+	}
+	if d := now.Unix() - int64(t.TimeSigned); d > int64(t.Fudge) || -d > int64(t.Fudge) {
+		return errors.New("TSIG time on response out of range")
+	}
+	v.prior, v.unsigned, v.pending = t.MAC, nil, 0
+	v.signed++
+	return nil
+}
+
+// done checks the response ended with a signed message
+func (v *tsigVerifier) done() error {
+	if v.key != nil && v.pending > 0 {
+		return errors.New("last message of the response not signed")
+	}
+	return nil
+}
+
+// answerNotify answers a NOTIFY (RFC 1996 section 3.7) for one of our
+// secondary zones. it is only taken from the zone's primary, signed with the
+// zone's key when it has one, and makes the zone check its primary right away
+func answerNotify(data []byte, hdr dns_header, q dns_question, client net.IP) []byte {
+	name := fqdn(strings.ToLower(q.Name))
+	var s *secondaryZone
+	secondaryMu.Lock()
+	for _, sz := range secondaries {
+		if sz.Zone == name {
+			s = sz
+		}
+	}
+	secondaryMu.Unlock()
+	if s == nil {
+		resp, _ := build_message(hdr, q, queryResult{Rcode: rcode_notauth})
+		return resp
+	}
+	refused, _ := build_message(hdr, q, queryResult{Rcode: rcode_refused})
+	if !isPrimary(s.Primary, client) {
+		log.Printf("secondary %s: NOTIFY from %s, not the primary", s.Zone, client)
+		return refused
+	}
+	tsig, key, tsigErr, err := verifyTSIG(data, time.Now())
+	switch {
+	case err != nil:
+		resp, _ := build_message(hdr, q, queryResult{Rcode: rcode_formerr})
+		return resp
+	case tsigErr != 0:
+		resp, _ := tsigErrorResponse(hdr, q, tsig, key, tsigErr, time.Now())
+		return resp
+	case s.KeyName != "" && (key == nil || !strings.EqualFold(fqdn(key.Name), fqdn(s.KeyName))):
+		log.Printf("secondary %s: NOTIFY from %s not signed with %s", s.Zone, client, s.KeyName)
+		return refused
+	case key != nil && !keyAllows(key, keyUseNotify):
+		log.Printf("secondary %s: NOTIFY from %s signed with %s, which is not for NOTIFY", s.Zone, client, key.Name)
+		return refused
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default: // a check is due already
+	}
+	resp, err := build_message(hdr, q, queryResult{})
+	if err == nil {
+		resp, err = newTSIGStream(key, tsig).sign(resp, time.Now())
+	}
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// isPrimary reports whether client is the address of primary ("host:port")
+func isPrimary(primary string, client net.IP) bool {
+	host, _, _ := net.SplitHostPort(primary)
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		addrs, _ = net.LookupHost(host)
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && client != nil && ip.Equal(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// secondaryState is a secondary zone's refresh status for the web ui
+type secondaryState struct {
+	Zone      string
+	View      string
+	Primary   string
+	Catalog   string // the catalog the zone is a member of, if any
+	Serial    uint32
+	Status    string
+	Refreshed time.Time
+	Expires   time.Time
+}
+
+// secondaryStatus lists the secondary zones for the web ui
+func secondaryStatus() []secondaryState {
+	secondaryMu.Lock()
+	defer secondaryMu.Unlock()
+	var out []secondaryState
+	for _, s := range secondaries {
+		st := secondaryState{Zone: s.Zone, View: s.View, Primary: s.Primary, Catalog: s.member, Serial: s.serial, Refreshed: s.refreshed, Expires: s.expires}
+		switch {
+		case s.expired:
+			st.Status = "expired"
+		case !s.loaded:
+			st.Status = "not transferred yet"
+		default:
+			st.Status = "serving"
+		}
+		if s.err != "" {
+			st.Status += ": " + s.err
+		}
+		out = append(out, st)
+	}
+	return out
+}
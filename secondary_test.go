@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSecondaryZone(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	primaryFile := filepath.Join(dir, "zone.primary.txt")
+	secondaryFile := filepath.Join(dir, "zone.secondary.txt")
+	copyFile := filepath.Join(dir, "zone.example.com.txt")
+	os.WriteFile(primaryFile, []byte("example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600\n"+
+		"www.example.com. A 192.0.2.1 300\n"), 0644)
+	os.WriteFile(secondaryFile, nil, 0644)
+
+	// the primary answers 127.0.0.1 over tcp, the secondary's view is what
+	// 127.0.0.2 gets
+	setupAXFR([]string{"127.0.0.1"}, []tsigKey{{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256}})
+	err := setupViews(
+		view{Name: "primary", Match: []string{"127.0.0.1/32"}, File: primaryFile},
+		view{Name: "secondary", Match: []string{"127.0.0.2/32"}, File: secondaryFile},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle_tcp_conn(c)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		setupSecondaries()
+		views = nil
+	})
+	sz := secondaryZone{Zone: "Example.com", Primary: ln.Addr().String(), KeyName: "axfr-key.", File: copyFile, View: "secondary"}
+	if err := setupSecondaries(sz); err != nil {
+		t.Fatal(err)
+	}
+	s := secondaries[0]
+
+	query := func(name string) *dns_msg {
+		t.Helper()
+		msg, err := parse_full_msg(answer_msg(testQuery(name, type_a), net.ParseIP("127.0.0.2"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	if msg := query("www.example.com."); msg.Hdr.Flags&rcode_mask != rcode_servfail {
+		t.Errorf("before the first transfer: %+v", msg)
+	}
+
+	// AXFR
+	now := time.Now()
+	if wait := s.refresh(now); wait != time.Hour {
+		t.Errorf("after AXFR next refresh in %v: %s", wait, s.err)
+	}
+	if msg := query("www.example.com."); len(msg.Answer) != 1 || net.IP(msg.Answer[0].Rdata).String() != "192.0.2.1" {
+		t.Errorf("after AXFR: %+v", msg)
+	}
+	if data, _ := os.ReadFile(copyFile); !strings.Contains(string(data), "www.example.com. A 192.0.2.1 300") {
+		t.Errorf("saved copy:\n%s", data)
+	}
+	// nothing changed: no transfer
+	if wait := s.refresh(now); wait != time.Hour || s.serial != 1 {
+		t.Errorf("unchanged primary: wait %v, serial %d, %s", wait, s.serial, s.err)
+	}
+
+	// IXFR: the change lands in the secondary's journal, an AXFR would drop it
+	primary := findView("primary").zone
+	primary.change("example.com.", nil, []rr{makeRR("mail.example.com.", type_a, 300, []byte{192, 0, 2, 25})})
+	s.refresh(now)
+	if msg := query("mail.example.com."); len(msg.Answer) != 1 || s.serial != 2 {
+		t.Errorf("after IXFR, serial %d: %+v", s.serial, msg)
+	}
+	if _, ok := s.tree.ixfrRecords("example.com.", 1); !ok {
+		t.Error("IXFR wasn't applied as a change")
+	}
+
+	// NOTIFY from the primary, signed with the zone's key, asks for a check
+	setupNotify(nil, "axfr-key.")
+	defer setupNotify(nil, "")
+	notify, err := notifyMessage("example.com.", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client, want := range map[string]uint16{"127.0.0.9": rcode_refused, "127.0.0.1": rcode_noerror} {
+		msg, err := parse_full_msg(answer_msg(notify, net.ParseIP(client), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Hdr.Flags&rcode_mask != want || (msg.Hdr.Flags&opcode_mask)>>11 != opcode_notify {
+			t.Errorf("NOTIFY from %s: %+v", client, msg.Hdr)
+		}
+	}
+	select {
+	case <-s.notify:
+	default:
+		t.Error("NOTIFY didn't trigger a check")
+	}
+	setupNotify(nil, "")
+	unsigned, _ := notifyMessage("example.com.", 3)
+	if msg, _ := parse_full_msg(answer_msg(unsigned, net.ParseIP("127.0.0.1"), false)); msg.Hdr.Flags&rcode_mask != rcode_refused {
+		t.Errorf("unsigned NOTIFY: %+v", msg.Hdr)
+	}
+
+	// the primary goes away: retry, then stop serving once expired
+	ln.Close()
+	if wait := s.refresh(now.Add(time.Hour)); wait != 10*time.Minute {
+		t.Errorf("primary down: next try in %v", wait)
+	}
+	if msg := query("www.example.com."); len(msg.Answer) != 1 {
+		t.Errorf("before expiry: %+v", msg)
+	}
+	s.refresh(now.Add(86401 * time.Second))
+	if msg := query("www.example.com."); msg.Hdr.Flags&rcode_mask != rcode_servfail || len(msg.Answer) != 0 {
+		t.Errorf("after expiry: %+v", msg)
+	}
+
+	// a restart serves the saved copy until the primary is back
+	if err := setupSecondaries(sz); err != nil {
+		t.Fatal(err)
+	}
+	if msg := query("mail.example.com."); len(msg.Answer) != 1 || secondaries[0].serial != 2 {
+		t.Errorf("from the saved copy: %+v", msg)
+	}
+}
+
+func TestSecondaryOutOfZone(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	secondaryFile := filepath.Join(dir, "zone.secondary.txt")
+	os.WriteFile(secondaryFile, []byte("example.net. SOA ns1.example.net. hostmaster.example.net. 1 3600 600 86400 300 3600\n"+
+		"www.example.net. A 192.0.2.80 300\n"), 0644)
+	if err := setupViews(view{Name: "secondary", Match: []string{"127.0.0.2/32"}, File: secondaryFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a primary that answers every transfer with the records in xfr
+	var mu sync.Mutex
+	var xfr []rr
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := read_tcp_msg(c)
+				if err != nil {
+					return
+				}
+				msg, err := parse_full_msg(req)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				answers := xfr
+				mu.Unlock()
+				if msg.Questions[0].Type_ == type_soa {
+					answers = answers[:1]
+				}
+				resp, _ := build_message(msg.Hdr, msg.Questions[0], queryResult{Answer: answers})
+				write_tcp_msg(c, resp)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		setupSecondaries()
+		views = nil
+	})
+	record := func(line string) rr {
+		r, err := parseRecord(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	soa1 := record("example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600")
+	soa2 := record("example.com. SOA ns1.example.com. hostmaster.example.com. 2 3600 600 86400 300 3600")
+	www := record("www.example.com. A 192.0.2.1 300")
+	evil := record("www.example.net. A 198.51.100.1 300")
+
+	if err := setupSecondaries(secondaryZone{Zone: "example.com.", Primary: ln.Addr().String(), File: filepath.Join(dir, "zone.example.com.txt"), View: "secondary"}); err != nil {
+		t.Fatal(err)
+	}
+	s := secondaries[0]
+	tree := findView("secondary").zone
+	other := func() string {
+		rrs := tree.get("www.example.net.")
+		if len(rrs) != 1 {
+			return fmt.Sprint(rrs)
+		}
+		return net.IP(rrs[0].Rdata).String()
+	}
+	now := time.Now()
+
+	// AXFR with a record of another zone: refused as a whole
+	mu.Lock()
+	xfr = []rr{soa1, www, evil, soa1}
+	mu.Unlock()
+	s.refresh(now)
+	if s.serving() || !strings.Contains(s.err, "outside the zone") || len(tree.get("www.example.com.")) != 0 || other() != "192.0.2.80" {
+		t.Errorf("out of zone AXFR: serving %v, err %q, www.example.net. %s", s.serving(), s.err, other())
+	}
+
+	mu.Lock()
+	xfr = []rr{soa1, www, soa1}
+	mu.Unlock()
+	if s.refresh(now); !s.serving() {
+		t.Fatalf("AXFR: %s", s.err)
+	}
+
+	// and the same for IXFR
+	mu.Lock()
+	xfr = []rr{soa2, soa1, soa2, evil, soa2}
+	mu.Unlock()
+	s.refresh(now)
+	if !strings.Contains(s.err, "outside the zone") || s.serial != 1 || other() != "192.0.2.80" {
+		t.Errorf("out of zone IXFR: serial %d, err %q, www.example.net. %s", s.serial, s.err, other())
+	}
+}
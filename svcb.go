@@ -0,0 +1,318 @@
+// SVCB and HTTPS records (RFC 9460)
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SvcParamKeys
+const (
+	svcMandatory     = 0
+	svcALPN          = 1
+	svcNoDefaultALPN = 2
+	svcPort          = 3
+	svcIPv4Hint      = 4
+	svcECH           = 5
+	svcIPv6Hint      = 6
+)
+
+var svcKeyNames = map[uint16]string{
+	svcMandatory:     "mandatory",
+	svcALPN:          "alpn",
+	svcNoDefaultALPN: "no-default-alpn",
+	svcPort:          "port",
+	svcIPv4Hint:      "ipv4hint",
+	svcECH:           "ech",
+	svcIPv6Hint:      "ipv6hint",
+}
+
+func svcKeyToString(k uint16) string {
+	if name, ok := svcKeyNames[k]; ok {
+		return name
+	}
+	return "key" + strconv.Itoa(int(k))
+}
+
+func stringToSvcKey(s string) (uint16, error) {
+	s = strings.ToLower(s)
+	for k, name := range svcKeyNames {
+		if name == s {
+			return k, nil
+		}
+	}
+	if strings.HasPrefix(s, "key") {
+		if n, err := strconv.ParseUint(s[3:], 10, 16); err == nil && n != 65535 {
+			return uint16(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown svcparam key %q", s)
+}
+
+// parseSVCB parses "<priority> <target> [key=value...]"
+func parseSVCB(fields []string) ([]byte, error) {
+	if len(fields) < 2 {
+		return nil, errors.New("svcb needs priority and target")
+	}
+	priority, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad svcb priority %q", fields[0])
+	}
+	target, err := encodeName(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	if priority == 0 && len(fields) > 2 {
+		return nil, errors.New("svcb alias mode (priority 0) takes no parameters")
+	}
+
+	params := map[uint16][]byte{}
+	for _, f := range fields[2:] {
+		keyStr, val, _ := strings.Cut(f, "=")
+		key, err := stringToSvcKey(keyStr)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := params[key]; dup {
+			return nil, fmt.Errorf("duplicate svcparam %s", svcKeyToString(key))
+		}
+		if val == "" && key != svcNoDefaultALPN {
+			return nil, fmt.Errorf("svcparam %s needs a value", svcKeyToString(key))
+		}
+		v, err := parseSvcValue(key, val)
+		if err != nil {
+			return nil, err
+		}
+		params[key] = v
+	}
+	if err := checkSvcParams(params); err != nil {
+		return nil, err
+	}
+
+	out := binary.BigEndian.AppendUint16(nil, uint16(priority))
+	out = append(out, target...)
+	for _, k := range sortedSvcKeys(params) {
+		out = binary.BigEndian.AppendUint16(out, k)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(params[k])))
+		out = append(out, params[k]...)
+	}
+	return out, nil
+}
+
+// parseSvcValue encodes one SvcParamValue
+func parseSvcValue(key uint16, val string) ([]byte, error) {
+	switch key {
+	case svcMandatory:
+		var keys []uint16
+		for _, s := range strings.Split(val, ",") {
+			k, err := stringToSvcKey(s)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		var out []byte
+		for i, k := range keys {
+			if i > 0 && keys[i-1] == k {
+				return nil, fmt.Errorf("mandatory lists %s twice", svcKeyToString(k))
+			}
+			out = binary.BigEndian.AppendUint16(out, k)
+		}
+		return out, nil
+	case svcALPN:
+		var out []byte
+		for _, id := range strings.Split(val, ",") {
+			if id == "" || len(id) > 255 {
+				return nil, fmt.Errorf("bad alpn id %q", id)
+			}
+			out = append(out, byte(len(id)))
+			out = append(out, id...)
+		}
+		return out, nil
+	case svcNoDefaultALPN:
+		if val != "" {
+			return nil, errors.New("no-default-alpn takes no value")
+		}
+		return []byte{}, nil
+	case svcPort:
+		port, err := strconv.ParseUint(val, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q", val)
+		}
+		return binary.BigEndian.AppendUint16(nil, uint16(port)), nil
+	case svcIPv4Hint, svcIPv6Hint:
+		var out []byte
+		for _, s := range strings.Split(val, ",") {
+			ip := net.ParseIP(s)
+			if key == svcIPv4Hint && (ip == nil || ip.To4() == nil) {
+				return nil, fmt.Errorf("bad ipv4hint address %q", s)
+			}
+			if key == svcIPv6Hint && (ip == nil || ip.To4() != nil) {
+				return nil, fmt.Errorf("bad ipv6hint address %q", s)
+			}
+			if key == svcIPv4Hint {
+				out = append(out, ip.To4()...)
+			} else {
+				out = append(out, ip.To16()...)
+			}
+		}
+		return out, nil
+	case svcECH:
+		ech, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("bad ech config: %v", err)
+		}
+		return ech, nil
+	}
+	// keyNNNNN: value is taken as plain text
+	return []byte(val), nil
+}
+
+// checkSvcParams applies the cross-parameter rules of RFC 9460 section 8
+func checkSvcParams(params map[uint16][]byte) error {
+	if m, ok := params[svcMandatory]; ok {
+		for i := 0; i+1 < len(m); i += 2 {
+			k := binary.BigEndian.Uint16(m[i:])
+			if k == svcMandatory {
+				return errors.New("mandatory must not list itself")
+			}
+			if _, ok := params[k]; !ok {
+				return fmt.Errorf("mandatory key %s is missing", svcKeyToString(k))
+			}
+		}
+	}
+	if _, ok := params[svcNoDefaultALPN]; ok {
+		if _, ok := params[svcALPN]; !ok {
+			return errors.New("no-default-alpn needs alpn")
+		}
+	}
+	return nil
+}
+
+func sortedSvcKeys(params map[uint16][]byte) []uint16 {
+	keys := make([]uint16, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// formatSVCB writes svcb rdata in presentation format. it errors on
+// anything parseSVCB would not accept back, so the caller can use \# instead
+func formatSVCB(rdata []byte) (string, error) {
+	if len(rdata) < 3 {
+		return "", errors.New("svcb rdata too short")
+	}
+	priority := binary.BigEndian.Uint16(rdata)
+	target, off, err := readRdataName(rdata, 2)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{strconv.Itoa(int(priority)), target}
+	params := map[uint16][]byte{}
+	last := -1
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return "", errors.New("truncated svcparam")
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		n := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if int(key) <= last || off+n > len(rdata) {
+			return "", errors.New("svcparams out of order or truncated")
+		}
+		last = int(key)
+		val := rdata[off : off+n]
+		off += n
+		s, err := formatSvcValue(key, val)
+		if err != nil {
+			return "", err
+		}
+		params[key] = val
+		if key == svcNoDefaultALPN {
+			parts = append(parts, svcKeyToString(key))
+		} else {
+			parts = append(parts, svcKeyToString(key)+"="+s)
+		}
+	}
+	if priority == 0 && len(params) > 0 {
+		return "", errors.New("svcb alias mode with parameters")
+	}
+	if err := checkSvcParams(params); err != nil {
+		return "", err
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func formatSvcValue(key uint16, val []byte) (string, error) {
+	var items []string
+	switch key {
+	case svcMandatory:
+		if len(val) == 0 || len(val)%2 != 0 {
+			return "", errors.New("bad mandatory value")
+		}
+		for i := 0; i < len(val); i += 2 {
+			items = append(items, svcKeyToString(binary.BigEndian.Uint16(val[i:])))
+		}
+	case svcALPN:
+		for i := 0; i < len(val); {
+			n := int(val[i])
+			if n == 0 || i+1+n > len(val) {
+				return "", errors.New("bad alpn value")
+			}
+			id := string(val[i+1 : i+1+n])
+			if strings.ContainsAny(id, ", \t\"\\=") {
+				return "", errors.New("alpn id needs escaping")
+			}
+			items = append(items, id)
+			i += 1 + n
+		}
+		if len(items) == 0 {
+			return "", errors.New("empty alpn value")
+		}
+	case svcNoDefaultALPN:
+		if len(val) != 0 {
+			return "", errors.New("no-default-alpn with a value")
+		}
+	case svcPort:
+		if len(val) != 2 {
+			return "", errors.New("bad port value")
+		}
+		items = append(items, strconv.Itoa(int(binary.BigEndian.Uint16(val))))
+	case svcIPv4Hint, svcIPv6Hint:
+		size := 4
+		if key == svcIPv6Hint {
+			size = 16
+		}
+		if len(val) == 0 || len(val)%size != 0 {
+			return "", errors.New("bad address hint")
+		}
+		for i := 0; i < len(val); i += size {
+			items = append(items, net.IP(val[i:i+size]).String())
+		}
+	case svcECH:
+		if len(val) == 0 {
+			return "", errors.New("empty ech value")
+		}
+		items = append(items, base64.StdEncoding.EncodeToString(val))
+	default:
+		for _, c := range val {
+			if c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+				return "", errors.New("svcparam value needs escaping")
+			}
+		}
+		if len(val) == 0 {
+			return "", errors.New("empty svcparam value")
+		}
+		items = append(items, string(val))
+	}
+	return strings.Join(items, ","), nil
+}
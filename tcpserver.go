@@ -1,11 +1,17 @@
-// tcpserver.go: TCP DNS server for AXFR/TSIG
+// tcpserver.go: TCP DNS server for queries and AXFR/TSIG
 package main
 
 import (
+	"errors"
+	"io"
 	"log"
 	"net"
+	"time"
 )
 
+// how long an idle tcp connection is kept open between queries (RFC 7766 section 6.2.3)
+var tcpIdleTimeout = 10 * time.Second
+
 func start_tcp_dns(port int16) {
 	addr := net.TCPAddr{Port: int(port), IP: net.IPv4zero}
 	ln, err := net.ListenTCP("tcp", &addr)
@@ -23,9 +29,63 @@ func start_tcp_dns(port int16) {
 			log.Println("tcp accept error:", err)
 			continue
 		}
-		go func(c net.Conn) {
-			remoteIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
-			handleAXFR(c, remoteIP)
-		}(conn)
+		go handle_tcp_conn(conn)
+	}
+}
+
+// handle_tcp_conn answers length-prefixed queries until the client goes quiet.
+// a zone transfer takes over the connection
+func handle_tcp_conn(c net.Conn) {
+	defer c.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Recovered from panic in handle_tcp_conn:", r)
+		}
+	}()
+	remoteIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := read_tcp_msg(c)
+		if err != nil {
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if _, q, err := parse_dns_msg(msg); err == nil && (q.Type_ == 252 || q.Type_ == 251) { // AXFR, IXFR QTYPE
+			handleAXFR(c, remoteIP, msg)
+			return
+		}
+		resp := answer_msg(msg, net.ParseIP(remoteIP), true)
+		if resp == nil {
+			return
+		}
+		if err := write_tcp_msg(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// read_tcp_msg reads a 2-byte length prefix, then the DNS message
+func read_tcp_msg(r io.Reader) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+	msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
+	if msgLen < 12 {
+		return nil, errors.New("message too short")
+	}
+	msg := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// write_tcp_msg writes msg with its 2-byte length prefix
+func write_tcp_msg(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("message too long for tcp")
 	}
+	_, err := w.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+	return err
 }
@@ -6,7 +6,24 @@ const (
 	qr_mask     = 1 << 15
 	opcode_mask = 0x7800
 	aa_mask     = 1 << 10
+	tc_mask     = 1 << 9
 	rcode_mask  = 0x000f
+	rd_mask     = 1 << 8
+)
+
+// rcodes
+const (
+	rcode_noerror  = 0
+	rcode_formerr  = 1
+	rcode_servfail = 2
+	rcode_nxdomain = 3
+	rcode_notimp   = 4
+	rcode_refused  = 5
+	rcode_yxdomain = 6
+	rcode_yxrrset  = 7
+	rcode_nxrrset  = 8
+	rcode_notauth  = 9
+	rcode_notzone  = 10
 )
 
 // rr types
@@ -15,9 +32,22 @@ const (
 	type_ns    = 2
 	type_soa   = 6
 	type_cname = 5
+	type_ptr   = 12
+	type_hinfo = 13
 	type_mx    = 15
+	type_ds    = 43
 	type_aaaa  = 28
 	type_txt   = 16
+	type_loc   = 29
+	type_srv   = 33
+	type_naptr = 35
+	type_sshfp = 44
+	type_tlsa  = 52
+	type_svcb  = 64
+	type_https = 65
+	type_tsig  = 250
+	type_uri   = 256
+	type_alias = 65401 // pseudo record, flattened at query time (same code PowerDNS uses)
 	class_in   = 1
 )
 
@@ -33,6 +63,10 @@ type rr struct {
 	// For MX only (optional, for convenience)
 	Preference uint16
 	Exchange   string
+	// zone file options, never sent on the wire
+	Weight uint16       // weight= for the weighted order policy, 0 when not set
+	Check  *healthCheck // check= health check, nil when not checked
+	Backup bool         // only served when no other address is healthy
 }
 
 // SOA RDATA struct (for convenience)
@@ -62,3 +96,12 @@ type dns_question struct {
 	Type_ uint16
 	Class uint16
 }
+
+// full dns message, all sections
+type dns_msg struct {
+	Hdr        dns_header
+	Questions  []dns_question
+	Answer     []rr
+	Authority  []rr
+	Additional []rr
+}
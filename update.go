@@ -0,0 +1,426 @@
+// dynamic updates (RFC 2136): records added and removed over DNS by the
+// holders of TSIG keys allowed to
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const opcode_update = 5
+
+// classes with a special meaning in an UPDATE (RFC 2136 section 2.4 and 2.5)
+const (
+	class_none = 254
+	class_any  = 255
+)
+
+// updatePolicy is what one TSIG key may change with UPDATE. Names are exact
+// ("host.example.com.") or "*.dhcp.example.com." for every name below
+// dhcp.example.com.; no Types means every type
+type updatePolicy struct {
+	Key   string
+	Names []string
+	Types []string // eg "A", "AAAA", "TXT"
+
+	types map[uint16]bool
+}
+
+// configured update policies, one per key. keys without one can't update
+var updatePolicies []*updatePolicy
+
+// update policy config (to call while dns startup)
+func setupUpdatePolicy(ps ...updatePolicy) error {
+	var out []*updatePolicy
+	for _, p := range ps {
+		p := p
+		if p.Key == "" || len(p.Names) == 0 {
+			return fmt.Errorf("update policy needs a key and names")
+		}
+		p.Key = fqdn(strings.ToLower(p.Key))
+		for i, n := range p.Names {
+			p.Names[i] = fqdn(strings.ToLower(n))
+		}
+		if len(p.Types) > 0 {
+			p.types = map[uint16]bool{}
+		}
+		for _, ts := range p.Types {
+			t, ok := stringToType(ts)
+			if !ok {
+				return fmt.Errorf("update policy for %s: unknown type %q", p.Key, ts)
+			}
+			p.types[t] = true
+		}
+		out = append(out, &p)
+	}
+	updatePolicies = out
+	return nil
+}
+
+// updatePolicyFor finds the policy of a key, nil when it has none
+func updatePolicyFor(keyName string) *updatePolicy {
+	for _, p := range updatePolicies {
+		if strings.EqualFold(p.Key, fqdn(keyName)) {
+			return p
+		}
+	}
+	return nil
+}
+
+// allows reports whether the policy's key may change the type t records of
+// name. t ANY (deleting every RRset of a name) needs a policy with no Types
+func (p *updatePolicy) allows(name string, t uint16) bool {
+	if p.types != nil && !p.types[t] {
+		return false
+	}
+	for _, n := range p.Names {
+		if below, ok := strings.CutPrefix(n, "*."); ok {
+			if name != below && isBelow(name, below) {
+				return true
+			}
+		} else if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// answerUpdate handles an UPDATE: it has to be signed with a key that may
+// update and has a policy, then the prerequisites are checked and the updates
+// applied in one step through the zone store (RFC 2136 section 3), which
+// bumps the serial. the zone's view is saved afterwards
+func answerUpdate(data []byte, client net.IP) []byte {
+	msg, err := parse_full_msg(data)
+	if err != nil || len(msg.Questions) == 0 {
+		log.Printf("UPDATE: failed to parse DNS msg: %v", err)
+		return nil
+	}
+	hdr, q := msg.Hdr, msg.Questions[0]
+	signer := &tsigStream{}
+	reply := func(rcode uint16) []byte {
+		resp, err := build_message(hdr, q, queryResult{Rcode: rcode})
+		if err == nil {
+			resp, err = signer.sign(resp, time.Now())
+		}
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+	refuse := func(why string) []byte {
+		log.Printf("UPDATE of %s from %s refused: %s", q.Name, client, why)
+		logAnalyticsEvent("refused", fqdn(strings.ToLower(q.Name))+" UPDATE from "+client.String())
+		return reply(rcode_refused)
+	}
+	// the zone section (RFC 2136 section 3.1.1)
+	if len(msg.Questions) != 1 || q.Type_ != type_soa {
+		return reply(rcode_formerr)
+	}
+
+	tsig, key, tsigErr, err := verifyTSIG(data, time.Now())
+	switch {
+	case err != nil:
+		return reply(rcode_formerr)
+	case tsigErr != 0:
+		log.Printf("UPDATE: TSIG error %d from %s (key %s)", tsigErr, client, tsig.Name)
+		resp, _ := tsigErrorResponse(hdr, q, tsig, key, tsigErr, time.Now())
+		return resp
+	case key == nil:
+		return refuse("not signed")
+	}
+	signer = newTSIGStream(key, tsig)
+	policy := updatePolicyFor(key.Name)
+	if !keyAllows(key, keyUseUpdate) || policy == nil {
+		return refuse("key " + key.Name + " may not update")
+	}
+	v := viewFor(client, key.Name)
+	if v == nil {
+		return refuse("no view")
+	}
+	apex := fqdn(strings.ToLower(q.Name))
+	if v.zone.findZoneApex(apex) != apex {
+		return reply(rcode_notauth)
+	}
+	if secondaryFor(v.zone, apex) != nil {
+		return refuse("secondary zone, update the primary")
+	}
+
+	var prereqs, updates []rr
+	for _, r := range msg.Answer {
+		prereqs = append(prereqs, lowerName(r))
+	}
+	for _, r := range msg.Authority {
+		updates = append(updates, lowerName(r))
+	}
+	if rcode := v.zone.prescanUpdate(apex, updates); rcode != rcode_noerror {
+		return reply(rcode)
+	}
+	for _, u := range updates {
+		if !policy.allows(u.Name, u.Type_) {
+			return refuse(fmt.Sprintf("key %s may not change %s %s", key.Name, u.Name, typeToString(u.Type_)))
+		}
+	}
+
+	rcode := uint16(rcode_noerror)
+	v.zone.changeWith(apex, func() ([]rr, []rr, bool) {
+		if rcode = v.zone.checkPrereqsLocked(apex, prereqs); rcode != rcode_noerror {
+			return nil, nil, false
+		}
+		del, add := v.zone.updateEditsLocked(apex, updates)
+		return del, add, true
+	})
+	if rcode != rcode_noerror {
+		return reply(rcode)
+	}
+	if len(updates) > 0 {
+		if err := v.save(); err != nil {
+			log.Printf("UPDATE of %s: could not save: %v", apex, err)
+		}
+	}
+	log.Printf("UPDATE of %s from %s (key %s): %d prerequisites, %d updates", apex, client, key.Name, len(prereqs), len(updates))
+	return reply(rcode_noerror)
+}
+
+// lowerName returns r with its owner name lowercased, keeping its class
+func lowerName(r rr) rr {
+	out := makeRR(strings.ToLower(r.Name), r.Type_, r.TTL, r.Rdata)
+	out.Class = r.Class
+	return out
+}
+
+// isMetaType reports whether t is a QTYPE or meta type, which can't be stored
+func isMetaType(t uint16) bool {
+	return t == 41 || (t >= 128 && t <= 255)
+}
+
+// prescanUpdate checks the update section before anything is applied (RFC
+// 2136 section 3.4.1). names in a child zone with its own SOA are NOTZONE
+func (z *zoneTree) prescanUpdate(apex string, updates []rr) uint16 {
+	for _, u := range updates {
+		if z.findZoneApex(u.Name) != apex {
+			return rcode_notzone
+		}
+		switch u.Class {
+		case class_in:
+			if isMetaType(u.Type_) || (u.Type_ == type_soa && u.SOA == nil) {
+				return rcode_formerr
+			}
+		case class_any:
+			if u.TTL != 0 || len(u.Rdata) != 0 || (isMetaType(u.Type_) && u.Type_ != 255) {
+				return rcode_formerr
+			}
+		case class_none:
+			if u.TTL != 0 || isMetaType(u.Type_) {
+				return rcode_formerr
+			}
+		default:
+			return rcode_formerr
+		}
+	}
+	return rcode_noerror
+}
+
+// inZoneLocked reports whether name is in the zone at apex and not in a child
+// zone below it, with the lock held (findZoneApex takes the lock itself)
+func (z *zoneTree) inZoneLocked(apex, name string) bool {
+	for n := name; isBelow(n, apex); n = parentName(n) {
+		if n == apex {
+			return true
+		}
+		if hasType(z.rrsLocked(n), type_soa) {
+			return false
+		}
+	}
+	return false
+}
+
+// checkPrereqsLocked checks the prerequisite section (RFC 2136 section 3.2)
+// against the zone, with the lock held
+func (z *zoneTree) checkPrereqsLocked(apex string, prereqs []rr) uint16 {
+	// "RRset exists (value dependent)" compares whole RRsets, collected first
+	want := map[string][]rr{}
+	var order []string
+	for _, p := range prereqs {
+		if p.TTL != 0 {
+			return rcode_formerr
+		}
+		if !z.inZoneLocked(apex, p.Name) {
+			return rcode_notzone
+		}
+		rrs := z.rrsLocked(p.Name)
+		switch p.Class {
+		case class_any:
+			switch {
+			case len(p.Rdata) != 0:
+				return rcode_formerr
+			case p.Type_ == 255 && len(rrs) == 0:
+				return rcode_nxdomain
+			case p.Type_ != 255 && !hasType(rrs, p.Type_):
+				return rcode_nxrrset
+			}
+		case class_none:
+			switch {
+			case len(p.Rdata) != 0:
+				return rcode_formerr
+			case p.Type_ == 255 && len(rrs) > 0:
+				return rcode_yxdomain
+			case p.Type_ != 255 && hasType(rrs, p.Type_):
+				return rcode_yxrrset
+			}
+		case class_in:
+			k := p.Name + " " + typeToString(p.Type_)
+			if _, ok := want[k]; !ok {
+				order = append(order, k)
+			}
+			want[k] = append(want[k], p)
+		default:
+			return rcode_formerr
+		}
+	}
+	for _, k := range order {
+		ps := want[k]
+		var have []rr
+		for _, r := range z.rrsLocked(ps[0].Name) {
+			if r.Type_ == ps[0].Type_ {
+				have = append(have, r)
+			}
+		}
+		if !sameRRset(have, ps) {
+			return rcode_nxrrset
+		}
+	}
+	return rcode_noerror
+}
+
+// sameRRset reports whether a and b hold the same records, ignoring order,
+// duplicates and TTLs
+func sameRRset(a, b []rr) bool {
+	contains := func(rrs []rr, r rr) bool {
+		for _, x := range rrs {
+			if sameRecord(x, r) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range a {
+		if !contains(b, r) {
+			return false
+		}
+	}
+	for _, r := range b {
+		if !contains(a, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateEditsLocked works the update section through a copy of the names it
+// touches, in order (RFC 2136 section 3.4.2), and returns the difference to
+// the zone as records to delete and add
+func (z *zoneTree) updateEditsLocked(apex string, updates []rr) (del, add []rr) {
+	work := map[string][]rr{}
+	var names []string
+	for _, u := range updates {
+		if _, ok := work[u.Name]; !ok {
+			work[u.Name] = append([]rr(nil), z.rrsLocked(u.Name)...)
+			names = append(names, u.Name)
+		}
+		rrs := work[u.Name]
+		switch u.Class {
+		case class_in:
+			rrs = updateAdd(apex, rrs, u)
+		case class_any:
+			var keep []rr
+			for _, r := range rrs {
+				// the apex SOA and NS records can't be deleted as a whole
+				protected := u.Name == apex && (r.Type_ == type_soa || r.Type_ == type_ns)
+				if protected || (u.Type_ != 255 && r.Type_ != u.Type_) {
+					keep = append(keep, r)
+				}
+			}
+			rrs = keep
+		case class_none:
+			ns := 0
+			for _, r := range rrs {
+				if r.Type_ == type_ns {
+					ns++
+				}
+			}
+			if u.Type_ == type_soa || (u.Type_ == type_ns && u.Name == apex && ns <= 1) {
+				break // never the SOA, nor the zone's last NS
+			}
+			var keep []rr
+			for _, r := range rrs {
+				if !sameRecord(r, u) {
+					keep = append(keep, r)
+				}
+			}
+			rrs = keep
+		}
+		work[u.Name] = rrs
+	}
+	// same name, type, rdata and TTL
+	identical := func(rrs []rr, r rr) bool {
+		for _, x := range rrs {
+			if sameRecord(x, r) && x.TTL == r.TTL {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range names {
+		before := z.rrsLocked(name)
+		for _, r := range before {
+			if !identical(work[name], r) {
+				del = append(del, r)
+			}
+		}
+		for _, r := range work[name] {
+			if !identical(before, r) {
+				add = append(add, r)
+			}
+		}
+	}
+	return del, add
+}
+
+// updateAdd adds u to the records of its name the way RFC 2136 section
+// 3.4.2.2 says: an SOA only replaces one with a lower serial, CNAME and other
+// data don't mix, and adding a record that is there already updates its TTL
+func updateAdd(apex string, rrs []rr, u rr) []rr {
+	hasCNAME, hasOther := false, false
+	for _, r := range rrs {
+		hasCNAME = hasCNAME || r.Type_ == type_cname
+		hasOther = hasOther || r.Type_ != type_cname
+	}
+	switch {
+	case u.Type_ == type_soa:
+		for i, r := range rrs {
+			if r.Type_ == type_soa {
+				if u.Name == apex && r.SOA != nil && serialLess(r.SOA.Serial, u.SOA.Serial) {
+					rrs[i] = u
+				}
+				return rrs
+			}
+		}
+		return rrs // no new zones by UPDATE
+	case u.Type_ == type_cname && hasOther, u.Type_ != type_cname && hasCNAME:
+		return rrs
+	}
+	u.Class = class_in
+	for i, r := range rrs {
+		if sameRecord(r, u) {
+			rrs[i].TTL = u.TTL
+			return rrs
+		}
+	}
+	if u.Type_ == type_cname {
+		return []rr{u} // a name has one CNAME
+	}
+	return append(rrs, u)
+}
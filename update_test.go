@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateMsg builds an UPDATE for zone, signed with keyName unless it is ""
+func updateMsg(t *testing.T, zone, keyName string, prereqs, updates []rr) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, dns_header{Id: 0x5151, Flags: opcode_update << 11, Qdcount: 1,
+		Ancount: uint16(len(prereqs)), Nscount: uint16(len(updates))})
+	write_name(buf, zone)
+	binary.Write(buf, binary.BigEndian, uint16(type_soa))
+	binary.Write(buf, binary.BigEndian, uint16(class_in))
+	for _, r := range append(prereqs, updates...) {
+		write_rr(buf, r)
+	}
+	if keyName == "" {
+		return buf.Bytes()
+	}
+	key := getTSIGKey(keyName)
+	msg, err := signTSIG(buf.Bytes(), key, nil, &tsigRecord{Name: key.Name, Algorithm: key.Algorithm,
+		TimeSigned: uint64(time.Now().Unix()), Fudge: 300, OrigID: 0x5151}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// withClass is r with another class, for the prerequisites and deletes
+func withClass(r rr, class uint16) rr {
+	r.Class = class
+	return r
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	file := filepath.Join(dir, "zone.txt")
+	os.WriteFile(file, []byte("example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600\n"+
+		"example.com. NS ns1.example.com. 3600\n"+
+		"www.example.com. A 192.0.2.1 300\n"+
+		"mail.example.com. A 192.0.2.25 300\n"+
+		"mail.example.com. TXT \"v=spf1 -all\" 300\n"+
+		"child.example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600\n"), 0644)
+	if err := setupViews(view{Name: "default", Match: []string{"0.0.0.0/0", "::/0"}, File: file}); err != nil {
+		t.Fatal(err)
+	}
+	setupAXFR(nil, []tsigKey{
+		{Name: "dhcp-key.", Secret: "ZGhjcGtleQ==", Algorithm: TSIG_HMAC_SHA256, Uses: []string{keyUseUpdate}},
+		{Name: "admin-key.", Secret: "YWRtaW5rZXk=", Algorithm: TSIG_HMAC_SHA256},
+		{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256, Uses: []string{keyUseTransfer}},
+	})
+	err := setupUpdatePolicy(
+		updatePolicy{Key: "dhcp-key.", Names: []string{"*.dhcp.example.com.", "www.example.com."}, Types: []string{"A", "AAAA"}},
+		updatePolicy{Key: "admin-key", Names: []string{"example.com.", "*.example.com."}},
+		updatePolicy{Key: "axfr-key.", Names: []string{"*.example.com."}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		views = nil
+		setupUpdatePolicy()
+		setupAXFR(nil, nil)
+	})
+	z := findView("default").zone
+	client := net.ParseIP("192.0.2.53")
+	update := func(keyName string, prereqs, updates []rr) *dns_msg {
+		t.Helper()
+		req := updateMsg(t, "example.com.", keyName, prereqs, updates)
+		resp := answer_msg(req, client, true)
+		if keyName != "" {
+			reqTSIG, _, _ := parseTSIG(req)
+			v := &tsigVerifier{key: getTSIGKey(keyName), prior: reqTSIG.MAC}
+			if err := v.verify(resp, time.Now()); err != nil {
+				t.Errorf("response TSIG: %v", err)
+			}
+		}
+		msg, err := parse_full_msg(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (msg.Hdr.Flags&opcode_mask)>>11 != opcode_update || msg.Hdr.Flags&qr_mask == 0 {
+			t.Errorf("response header %+v", msg.Hdr)
+		}
+		return msg
+	}
+	rcode := func(msg *dns_msg) uint16 { return msg.Hdr.Flags & rcode_mask }
+	a := func(name, ip string) rr { return makeRR(name, type_a, 300, net.ParseIP(ip).To4()) }
+	serial := func() uint32 {
+		soa, _ := z.soaLocked("example.com.")
+		return soa.SOA.Serial
+	}
+	rrset := func(name string, t uint16) []string {
+		var out []string
+		for _, r := range z.get(name) {
+			if r.Type_ == t {
+				out = append(out, formatRdata(r.Type_, r.Rdata))
+			}
+		}
+		return out
+	}
+
+	host := a("pc1.dhcp.example.com.", "192.0.2.101")
+	for name, tc := range map[string]struct {
+		key     string
+		updates []rr
+		want    uint16
+	}{
+		"unsigned":              {"", []rr{host}, rcode_refused},
+		"key not for updates":   {"axfr-key.", []rr{host}, rcode_refused},
+		"type not in policy":    {"dhcp-key.", []rr{makeRR("pc1.dhcp.example.com.", type_txt, 300, []byte("\x02hi"))}, rcode_refused},
+		"name not in policy":    {"dhcp-key.", []rr{a("mail.example.com.", "192.0.2.26")}, rcode_refused},
+		"outside the zone":      {"admin-key.", []rr{a("www.example.org.", "192.0.2.1")}, rcode_notzone},
+		"in a child zone":       {"admin-key.", []rr{a("foo.child.example.com.", "192.0.2.1")}, rcode_notzone},
+		"delete with rdata ttl": {"admin-key.", []rr{withClass(a("www.example.com.", "192.0.2.1"), class_none)}, rcode_formerr},
+	} {
+		if msg := update(tc.key, nil, tc.updates); rcode(msg) != tc.want {
+			t.Errorf("%s: rcode %d, want %d", name, rcode(msg), tc.want)
+		}
+	}
+	inChild := withClass(makeRR("child.example.com.", 255, 0, nil), class_any)
+	if msg := update("admin-key.", []rr{inChild}, []rr{a("www.example.com.", "192.0.2.2")}); rcode(msg) != rcode_notzone {
+		t.Errorf("prerequisite in a child zone: rcode %d", rcode(msg))
+	}
+	if serial() != 1 || z.get("pc1.dhcp.example.com.") != nil || z.get("foo.child.example.com.") != nil {
+		t.Fatalf("refused updates changed the zone")
+	}
+	if log, _ := os.ReadFile(analyticsFile); !strings.Contains(string(log), `"type":"refused","name":"example.com. UPDATE from 192.0.2.53"`) {
+		t.Errorf("refused update not in analytics:\n%s", log)
+	}
+
+	// add, within policy: one serial bump and a save
+	if msg := update("dhcp-key.", nil, []rr{host, a("pc1.dhcp.example.com.", "192.0.2.102")}); rcode(msg) != rcode_noerror {
+		t.Fatalf("add: %+v", msg)
+	}
+	if got := rrset("pc1.dhcp.example.com.", type_a); len(got) != 2 || serial() != 2 {
+		t.Errorf("after add: %v, serial %d", got, serial())
+	}
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), "pc1.dhcp.example.com. A 192.0.2.101 300") {
+		t.Errorf("not saved:\n%s", data)
+	}
+
+	// prerequisites: all of them hold or nothing happens
+	noName := withClass(makeRR("pc1.dhcp.example.com.", 255, 0, nil), class_none)
+	if msg := update("dhcp-key.", []rr{noName}, []rr{a("pc1.dhcp.example.com.", "192.0.2.103")}); rcode(msg) != rcode_yxdomain {
+		t.Errorf("name not in use: rcode %d", rcode(msg))
+	}
+	for _, tc := range []struct {
+		prereq rr
+		want   uint16
+	}{
+		{withClass(makeRR("pc2.dhcp.example.com.", 255, 0, nil), class_any), rcode_nxdomain},
+		{withClass(makeRR("www.example.com.", type_aaaa, 0, nil), class_any), rcode_nxrrset},
+		{withClass(makeRR("www.example.com.", type_a, 0, nil), class_none), rcode_yxrrset},
+		{makeRR("www.example.com.", type_a, 0, net.ParseIP("192.0.2.9").To4()), rcode_nxrrset},
+	} {
+		if msg := update("dhcp-key.", []rr{tc.prereq}, []rr{a("www.example.com.", "192.0.2.2")}); rcode(msg) != tc.want {
+			t.Errorf("prerequisite %+v: rcode %d, want %d", tc.prereq, rcode(msg), tc.want)
+		}
+	}
+	if serial() != 2 || len(rrset("www.example.com.", type_a)) != 1 {
+		t.Fatalf("failed prerequisites changed the zone")
+	}
+	// replace www's address only if it is still the old one
+	exact := makeRR("www.example.com.", type_a, 0, net.ParseIP("192.0.2.1").To4())
+	oldA := withClass(makeRR("www.example.com.", type_a, 0, net.ParseIP("192.0.2.1").To4()), class_none)
+	oldA.TTL = 0
+	if msg := update("dhcp-key.", []rr{exact}, []rr{oldA, a("www.example.com.", "192.0.2.2")}); rcode(msg) != rcode_noerror {
+		t.Errorf("replace: rcode %d", rcode(msg))
+	}
+	if got := rrset("www.example.com.", type_a); len(got) != 1 || got[0] != "192.0.2.2" || serial() != 3 {
+		t.Errorf("after replace: %v serial %d", got, serial())
+	}
+
+	// delete an RRset, a name; the apex SOA and NS stay
+	delMailTXT := withClass(makeRR("mail.example.com.", type_txt, 0, nil), class_any)
+	if msg := update("admin-key.", nil, []rr{delMailTXT}); rcode(msg) != rcode_noerror || rrset("mail.example.com.", type_txt) != nil || rrset("mail.example.com.", type_a) == nil {
+		t.Errorf("delete RRset: %+v", msg)
+	}
+	delName := withClass(makeRR("pc1.dhcp.example.com.", 255, 0, nil), class_any)
+	if msg := update("dhcp-key.", nil, []rr{delName}); rcode(msg) != rcode_refused {
+		t.Errorf("delete name with a key limited to types: rcode %d", rcode(msg))
+	}
+	delApex := withClass(makeRR("example.com.", 255, 0, nil), class_any)
+	delNS := withClass(makeRR("example.com.", type_ns, 0, z.get("example.com.")[1].Rdata), class_none)
+	if msg := update("admin-key.", nil, []rr{delName, delApex, delNS}); rcode(msg) != rcode_noerror {
+		t.Errorf("delete names: rcode %d", rcode(msg))
+	}
+	if z.get("pc1.dhcp.example.com.") != nil || rrset("example.com.", type_ns) == nil || rrset("example.com.", type_soa) == nil {
+		t.Errorf("after deletes: %v %v", z.get("pc1.dhcp.example.com."), z.get("example.com."))
+	}
+
+	// every applied update is one IXFR step
+	if recs, ok := z.ixfrRecords("example.com.", 1); !ok || len(recs) == 0 || recs[0].SOA.Serial != 5 {
+		t.Errorf("journal: %v %v", ok, describe(recs))
+	}
+}
@@ -0,0 +1,122 @@
+// split-horizon views: different zone data depending on who is asking
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// view is a named set of zones with its own zone file, served to the clients
+// it matches
+type view struct {
+	Name  string
+	Match []string // CIDRs of the clients this view answers, eg "10.0.0.0/8"
+	Keys  []string // TSIG key names; a query signed with one of these gets this view
+	File  string   // zone file, eg "zone.internal.txt"
+
+	nets []*net.IPNet
+	zone *zoneTree
+}
+
+// configured views, checked in order: the first match wins. with no views
+// configured everyone gets the default view, the global zone from zone.txt
+var views []*view
+
+// views config (to call while dns startup), loads every view's zone file.
+// put the catch-all view ("0.0.0.0/0", "::/0") last
+func setupViews(vs ...view) error {
+	var out []*view
+	for _, v := range vs {
+		v := v
+		if v.Name == "" || v.File == "" {
+			return fmt.Errorf("view needs a name and a zone file")
+		}
+		for _, cidr := range v.Match {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("view %s: %v", v.Name, err)
+			}
+			v.nets = append(v.nets, n)
+		}
+		v.zone = newZoneTree()
+		if err := load_zone(v.zone, v.File); err != nil {
+			log.Printf("view %s: could not load zone: %v", v.Name, err)
+		}
+		out = append(out, &v)
+	}
+	views = out
+	return nil
+}
+
+// defaultView is what everyone gets when no views are configured
+func defaultView() *view {
+	return &view{Name: "default", File: "zone.txt", zone: zone}
+}
+
+// allViews returns the configured views, or just the default one
+func allViews() []*view {
+	if len(views) == 0 {
+		return []*view{defaultView()}
+	}
+	return views
+}
+
+// findView returns the view called name, nil if there is none
+func findView(name string) *view {
+	for _, v := range allViews() {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// configuredView is the view a secondary zone or catalog named in its config
+// serves from. with no views configured that is the default view; otherwise
+// the view has to be named, nobody could query the default view
+func configuredView(name string) (*view, error) {
+	if name == "" {
+		if len(views) > 0 {
+			return nil, errors.New("needs a view, views are configured")
+		}
+		return defaultView(), nil
+	}
+	if v := findView(name); v != nil {
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown view %s", name)
+}
+
+// viewFor picks the view for a client. keyName is the TSIG key the request
+// was signed with ("" for none) and must only be passed once verified. a key
+// match wins over an address match. nil means no view matches the client
+func viewFor(client net.IP, keyName string) *view {
+	if len(views) == 0 {
+		return defaultView()
+	}
+	if keyName != "" {
+		for _, v := range views {
+			for _, k := range v.Keys {
+				if strings.EqualFold(fqdn(k), fqdn(keyName)) {
+					return v
+				}
+			}
+		}
+	}
+	for _, v := range views {
+		for _, n := range v.nets {
+			if client != nil && n.Contains(client) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// save writes the view's zone back to its file
+func (v *view) save() error {
+	return save_zone(v.zone, v.File)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestViews(t *testing.T) {
+	dir := t.TempDir()
+	analyticsFile = filepath.Join(dir, "analytics.log")
+	soa := "example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600\n"
+	internal := filepath.Join(dir, "zone.internal.txt")
+	external := filepath.Join(dir, "zone.txt")
+	os.WriteFile(internal, []byte(soa+"www.example.com. A 10.0.0.80 300\n"), 0644)
+	os.WriteFile(external, []byte(soa+"www.example.com. A 203.0.113.80 300\n"), 0644)
+	t.Cleanup(func() { views = nil })
+
+	if err := setupViews(view{Name: "internal", Match: []string{"10.0.0.0/8"}, File: internal}); err != nil {
+		t.Fatal(err)
+	}
+	query := func(client string) *dns_msg {
+		t.Helper()
+		msg, err := parse_full_msg(answer_msg(testQuery("www.example.com.", type_a), net.ParseIP(client), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	// nobody else matches a view
+	if msg := query("203.0.113.5"); msg.Hdr.Flags&rcode_mask != rcode_refused || len(msg.Answer) != 0 {
+		t.Errorf("client outside every view: %+v", msg)
+	}
+
+	err := setupViews(
+		view{Name: "internal", Match: []string{"10.0.0.0/8"}, Keys: []string{"internal-key."}, File: internal},
+		view{Name: "external", Match: []string{"0.0.0.0/0", "::/0"}, File: external},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client, want := range map[string]string{
+		"10.1.2.3":    "10.0.0.80",
+		"203.0.113.5": "203.0.113.80",
+		"2001:db8::1": "203.0.113.80",
+	} {
+		msg := query(client)
+		if len(msg.Answer) != 1 || net.IP(msg.Answer[0].Rdata).String() != want {
+			t.Errorf("%s got %+v, want %s", client, msg.Answer, want)
+		}
+	}
+	if v := viewFor(net.ParseIP("203.0.113.5"), "Internal-Key"); v == nil || v.Name != "internal" {
+		t.Errorf("key match picked %+v", v)
+	}
+
+	// a query signed with the internal key gets the internal view from
+	// anywhere, with a signed answer; a bad signature gets NOTAUTH
+	setupAXFR(nil, []tsigKey{{Name: "internal-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256}})
+	t.Cleanup(func() { setupAXFR(nil, nil) })
+	signed, err := signTSIG(testQuery("www.example.com.", type_a), getTSIGKey("internal-key."), nil, &tsigRecord{Name: "internal-key.",
+		Algorithm: TSIG_HMAC_SHA256, TimeSigned: uint64(time.Now().Unix()), Fudge: 300, OrigID: 0x1234}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := answer_msg(signed, net.ParseIP("203.0.113.5"), false)
+	msg, err := parse_full_msg(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 || net.IP(msg.Answer[0].Rdata).String() != "10.0.0.80" {
+		t.Errorf("signed query got %+v, want the internal view", msg.Answer)
+	}
+	if tsig, _, err := parseTSIG(resp); err != nil || tsig == nil || tsig.Name != "internal-key." || tsig.Error != 0 {
+		t.Errorf("answer to a signed query not signed: %+v %v", tsig, err)
+	}
+	signed[len(signed)-10] ^= 0xff // in the MAC
+	if msg, err := parse_full_msg(answer_msg(signed, net.ParseIP("203.0.113.5"), false)); err != nil || msg.Hdr.Flags&rcode_mask != rcode_notauth || len(msg.Answer) != 0 {
+		t.Errorf("badly signed query: %+v %v", msg, err)
+	}
+
+	// edits go to the view's own file
+	v := findView("internal")
+	v.zone.add(makeRR("new.example.com.", type_a, 300, net.ParseIP("10.0.0.81").To4()))
+	if err := v.save(); err != nil {
+		t.Fatal(err)
+	}
+	setupViews(
+		view{Name: "internal", Match: []string{"10.0.0.0/8"}, File: internal},
+		view{Name: "external", Match: []string{"0.0.0.0/0"}, File: external},
+	)
+	if len(findView("internal").zone.get("new.example.com.")) != 1 || len(findView("external").zone.get("new.example.com.")) != 0 {
+		t.Error("record added to the internal view leaked or was lost")
+	}
+
+	// with views, secondaries and catalogs have to say which one they are in
+	if err := setupSecondaries(secondaryZone{Zone: "example.org.", Primary: "192.0.2.53", File: filepath.Join(dir, "zone.example.org.txt")}); err == nil {
+		t.Error("secondary without a view accepted")
+	}
+	if err := setupCatalogs(catalogZone{Zone: "catalog.invalid."}); err == nil {
+		t.Error("catalog without a view accepted")
+	}
+	if err := setupSecondaries(secondaryZone{Zone: "example.org.", Primary: "192.0.2.53", File: filepath.Join(dir, "zone.example.org.txt"), View: "external"}); err != nil || secondaries[0].tree != findView("external").zone {
+		t.Errorf("secondary in a view: %v", err)
+	}
+	setupSecondaries()
+
+	if err := setupViews(view{Name: "bad", Match: []string{"10.0.0.0/33"}, File: internal}); err == nil {
+		t.Error("bad CIDR accepted")
+	}
+}
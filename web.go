@@ -2,11 +2,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"html/template"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -22,41 +19,10 @@ var templates *template.Template
 func init() {
 	funcMap := template.FuncMap{
 		"rrValue": func(r rr) string {
-			switch r.Type_ {
-			case type_a:
-				if len(r.Rdata) == 4 {
-					return net.IP(r.Rdata).String()
-				}
-			case type_aaaa:
-				if len(r.Rdata) == 16 {
-					return net.IP(r.Rdata).String()
-				}
-			case type_ns, type_cname:
-				return decode_name(r.Rdata)
-			case type_txt:
-				if len(r.Rdata) > 1 {
-					// Display quoted TXT value for correct deletion
-					return quoteTXT(string(r.Rdata[1:]))
-				}
-			case type_mx:
-				if len(r.Rdata) > 2 {
-					preference := int(r.Rdata[0])<<8 | int(r.Rdata[1])
-					exchange := decode_name(r.Rdata[2:])
-					return strconv.Itoa(preference) + " " + exchange
-				}
-			case type_soa:
-				if r.SOA != nil {
-					return r.SOA.MName + " " + r.SOA.RName + " " +
-						strconv.FormatUint(uint64(r.SOA.Serial), 10) + " " +
-						strconv.FormatUint(uint64(r.SOA.Refresh), 10) + " " +
-						strconv.FormatUint(uint64(r.SOA.Retry), 10) + " " +
-						strconv.FormatUint(uint64(r.SOA.Expire), 10) + " " +
-						strconv.FormatUint(uint64(r.SOA.Minimum), 10)
-				}
-			}
-			return "?"
+			return formatRdata(r.Type_, r.Rdata)
 		},
 		"unquoteTXT": unquoteTXT,
+		"health":     healthStatus,
 		"split":      strings.Split,
 	}
 	// Ensure layout.html is the base and index.html is available as a named template
@@ -89,6 +55,11 @@ func start_web() {
 }
 
 func handle_index(w http.ResponseWriter, r *http.Request) {
+	// records are edited per view, ?view=name (the first view by default)
+	v := findView(r.FormValue("view"))
+	if v == nil {
+		v = allViews()[0]
+	}
 	if r.Method == "POST" && r.FormValue("del") != "" {
 		name := strings.ToLower(r.FormValue("del"))
 		delTypeStr := r.FormValue("delType")
@@ -98,253 +69,64 @@ func handle_index(w http.ResponseWriter, r *http.Request) {
 			name += "."
 		}
 
-		records := zone[name]
-		var updatedRecords []rr
-
-		var delType uint16
-		switch strings.ToUpper(delTypeStr) {
-		case "A":
-			delType = type_a
-		case "AAAA":
-			delType = type_aaaa
-		case "NS":
-			delType = type_ns
-		case "CNAME":
-			delType = type_cname
-		case "TXT":
-			delType = type_txt
-		case "MX":
-			delType = type_mx
-		case "SOA":
-			delType = type_soa
-		default:
+		delType, ok := stringToType(delTypeStr)
+		delFields, delQuoted := splitRdata(delType, delValueStr)
+		delRdata, err := parseTextRdata(delType, delFields, delQuoted)
+		switch {
+		case secondaryFor(v.zone, name) != nil:
+			log.Printf("Warning: %s is in a secondary zone, edit it on the primary", name)
+		case !ok:
 			log.Printf("Warning: Unknown record type \"%s\" for deletion of %s", delTypeStr, name)
-			updatedRecords = records
-		}
-
-		var delRdata []byte
-		switch delType {
-		case type_a:
-			ip := net.ParseIP(delValueStr).To4()
-			if ip != nil {
-				delRdata = ip
-			} else {
-				log.Printf("Warning: Invalid IP address \"%s\" for A record deletion of %s", delValueStr, name)
-				updatedRecords = records
-			}
-		case type_aaaa:
-			ip := net.ParseIP(delValueStr).To16()
-			if ip != nil && ip.To4() == nil {
-				delRdata = ip
-			} else {
-				log.Printf("Warning: Invalid IPv6 address \"%s\" for AAAA record deletion of %s", delValueStr, name)
-				updatedRecords = records
-			}
-		case type_ns, type_cname:
-			if !strings.HasSuffix(delValueStr, ".") {
-				delValueStr += "."
-			}
-			buf := &strings.Builder{}
-			for _, label := range strings.Split(delValueStr, ".") {
-				if label == "" {
-					continue
-				}
-				buf.WriteByte(byte(len(label)))
-				buf.WriteString(label)
-			}
-			buf.WriteByte(0)
-			delRdata = []byte(buf.String())
-		case type_txt:
-			txtVal := unquoteTXT(delValueStr)
-			if len(txtVal) > 255 {
-				log.Printf("Warning: TXT value too long for deletion of %s", name)
-				updatedRecords = records
-			} else {
-				delRdata = append([]byte{byte(len(txtVal))}, []byte(txtVal)...)
-			}
-		case type_mx:
-			parts := strings.Fields(delValueStr)
-			if len(parts) == 2 {
-				preference, err := strconv.Atoi(parts[0])
-				if err != nil {
-					log.Printf("Warning: Invalid preference for MX record deletion of %s", name)
-					updatedRecords = records
-					break
-				}
-				exchange := parts[1]
-				if !strings.HasSuffix(exchange, ".") {
-					exchange += "."
-				}
-				buf := &bytes.Buffer{}
-				binary.Write(buf, binary.BigEndian, uint16(preference))
-				write_name(buf, exchange)
-				delRdata = buf.Bytes()
-			} else {
-				log.Printf("Warning: Invalid MX value for deletion of %s", name)
-				updatedRecords = records
-			}
-		case type_soa:
-			parts := strings.Fields(delValueStr)
-			if len(parts) == 7 {
-				mname := parts[0]
-				rname := parts[1]
-				serial, _ := strconv.ParseUint(parts[2], 10, 32)
-				refresh, _ := strconv.ParseUint(parts[3], 10, 32)
-				retry, _ := strconv.ParseUint(parts[4], 10, 32)
-				expire, _ := strconv.ParseUint(parts[5], 10, 32)
-				minimum, _ := strconv.ParseUint(parts[6], 10, 32)
-
-				if !strings.HasSuffix(mname, ".") {
-					mname += "."
-				}
-				if !strings.HasSuffix(rname, ".") {
-					rname += "."
-				}
-
-				buf := &bytes.Buffer{}
-				write_name(buf, mname)
-				write_name(buf, rname)
-				binary.Write(buf, binary.BigEndian, uint32(serial))
-				binary.Write(buf, binary.BigEndian, uint32(refresh))
-				binary.Write(buf, binary.BigEndian, uint32(retry))
-				binary.Write(buf, binary.BigEndian, uint32(expire))
-				binary.Write(buf, binary.BigEndian, uint32(minimum))
-				delRdata = buf.Bytes()
-			} else {
-				log.Printf("Warning: Invalid SOA value for deletion of %s", name)
-				updatedRecords = records
-			}
-		}
-		for _, r := range records {
-			if !(r.Name == name && r.Type_ == delType && bytes.Equal(r.Rdata, delRdata)) {
-				updatedRecords = append(updatedRecords, r)
-			}
-		}
-		if len(updatedRecords) == 0 {
-			delete(zone, name)
-		} else {
-			zone[name] = updatedRecords
+		case err != nil:
+			log.Printf("Warning: Invalid %s value \"%s\" for deletion of %s: %v", delTypeStr, delValueStr, name, err)
+		default:
+			v.zone.change(v.zone.findZoneApex(name), []rr{makeRR(name, delType, 0, delRdata)}, nil)
+			v.save()
 		}
-		save_zone("zone.txt")
 	}
 	if r.Method == "POST" {
 		name := strings.ToLower(r.FormValue("name"))
 		type_ := r.FormValue("type")
-		value := r.FormValue("value")
+		// options like "weight=2 check=tcp port=443" have their own field, a ';'
+		// in the value is part of it (DKIM, SPF)
+		value, options := r.FormValue("value"), r.FormValue("options")
 		ttl, _ := strconv.Atoi(r.FormValue("ttl"))
 		if name != "" && type_ != "" && ttl > 0 {
 			if !strings.HasSuffix(name, ".") {
 				name += "."
 			}
-			if (strings.ToUpper(type_) == "NS" || strings.ToUpper(type_) == "CNAME") && !strings.HasSuffix(value, ".") {
-				value += "."
-			}
-			var rrec rr
-			rrec.Name = name
-			rrec.Class = class_in
-			rrec.TTL = uint32(ttl)
+			// MX and SOA have their own form fields
 			switch strings.ToUpper(type_) {
-			case "A":
-				rrec.Type_ = type_a
-				ip := net.ParseIP(value).To4()
-				if ip != nil {
-					rrec.Rdata = ip
-					zone[name] = append(zone[name], rrec)
-				}
-			case "AAAA":
-				rrec.Type_ = type_aaaa
-				ip := net.ParseIP(value).To16()
-				if ip != nil && ip.To4() == nil {
-					rrec.Rdata = ip
-					zone[name] = append(zone[name], rrec)
-				}
-			case "NS":
-				rrec.Type_ = type_ns
-				buf := &strings.Builder{}
-				for _, label := range strings.Split(value, ".") {
-					if label == "" {
-						continue
-					}
-					buf.WriteByte(byte(len(label)))
-					buf.WriteString(label)
-				}
-				buf.WriteByte(0)
-				rrec.Rdata = []byte(buf.String())
-				zone[name] = append(zone[name], rrec)
-			case "CNAME":
-				rrec.Type_ = type_cname
-				buf := &strings.Builder{}
-				for _, label := range strings.Split(value, ".") {
-					if label == "" {
-						continue
-					}
-					buf.WriteByte(byte(len(label)))
-					buf.WriteString(label)
-				}
-				buf.WriteByte(0)
-				rrec.Rdata = []byte(buf.String())
-				zone[name] = append(zone[name], rrec)
-			case "TXT":
-				rrec.Type_ = type_txt
-				txtVal := unquoteTXT(value)
-				if len(txtVal) <= 255 {
-					rrec.Rdata = append([]byte{byte(len(txtVal))}, []byte(txtVal)...)
-					zone[name] = append(zone[name], rrec)
-				}
 			case "MX":
-				rrec.Type_ = type_mx
-				preference, err := strconv.Atoi(r.FormValue("preference"))
-				if err != nil {
-					log.Printf("Warning: Invalid preference for MX record: %v", err)
-					break
-				}
-				exchange := r.FormValue("exchange")
-				if !strings.HasSuffix(exchange, ".") {
-					exchange += "."
+				if value == "" {
+					value = r.FormValue("preference") + " " + r.FormValue("exchange")
 				}
-				buf := &bytes.Buffer{}
-				binary.Write(buf, binary.BigEndian, uint16(preference))
-				write_name(buf, exchange)
-				rrec.Rdata = buf.Bytes()
-				zone[name] = append(zone[name], rrec)
 			case "SOA":
-				rrec.Type_ = type_soa
-				mname := r.FormValue("mname")
-				rname := r.FormValue("rname")
-				serial, _ := strconv.ParseUint(r.FormValue("serial"), 10, 32)
-				refresh, _ := strconv.ParseUint(r.FormValue("refresh"), 10, 32)
-				retry, _ := strconv.ParseUint(r.FormValue("retry"), 10, 32)
-				expire, _ := strconv.ParseUint(r.FormValue("expire"), 10, 32)
-				minimum, _ := strconv.ParseUint(r.FormValue("minimum"), 10, 32)
-
-				if !strings.HasSuffix(mname, ".") {
-					mname += "."
+				if value == "" {
+					value = strings.Join([]string{r.FormValue("mname"), r.FormValue("rname"), r.FormValue("serial"),
+						r.FormValue("refresh"), r.FormValue("retry"), r.FormValue("expire"), r.FormValue("minimum")}, " ")
 				}
-				if !strings.HasSuffix(rname, ".") {
-					rname += "."
-				}
-
-				buf := &bytes.Buffer{}
-				write_name(buf, mname)
-				write_name(buf, rname)
-				binary.Write(buf, binary.BigEndian, uint32(serial))
-				binary.Write(buf, binary.BigEndian, uint32(refresh))
-				binary.Write(buf, binary.BigEndian, uint32(retry))
-				binary.Write(buf, binary.BigEndian, uint32(expire))
-				binary.Write(buf, binary.BigEndian, uint32(minimum))
-				rrec.Rdata = buf.Bytes()
-				rrec.SOA = &soaRdata{
-					MName:   mname,
-					RName:   rname,
-					Serial:  uint32(serial),
-					Refresh: uint32(refresh),
-					Retry:   uint32(retry),
-					Expire:  uint32(expire),
-					Minimum: uint32(minimum),
+			}
+			t, ok := stringToType(type_)
+			fields, quoted := splitRdata(t, value)
+			if secondaryFor(v.zone, name) != nil {
+				log.Printf("Warning: %s is in a secondary zone, edit it on the primary", name)
+			} else if !ok {
+				log.Printf("Warning: Unknown record type \"%s\" for %s", type_, name)
+			} else if rdata, err := parseTextRdata(t, fields, quoted); err != nil {
+				log.Printf("Warning: Invalid %s value \"%s\" for %s: %v", type_, value, name, err)
+			} else {
+				rec := makeRR(name, t, uint32(ttl), rdata)
+				if err := applyRecordOptions(&rec, options); err != nil {
+					log.Printf("Warning: Invalid options \"%s\" for %s: %v", options, name, err)
+				} else if rec.Check != nil && rec.Check.Cmd != "" {
+					// the web ui mustn't be a way to run programs on the server
+					log.Printf("Warning: check=cmd for %s can only be set in the zone file", name)
+				} else {
+					v.zone.change(v.zone.findZoneApex(name), nil, []rr{rec})
+					v.save()
 				}
-				zone[name] = append(zone[name], rrec)
 			}
-			save_zone("zone.txt")
 		}
 	}
 	// Update analytics summary before rendering
@@ -354,32 +136,14 @@ func handle_index(w http.ResponseWriter, r *http.Request) {
 	// Categorize records by type for the template
 	categorizedRecords := make(map[string]map[string][]rr)
 	// Ensure all desired record types are present in the map for the UI
-	recordTypes := []string{"A", "AAAA", "NS", "CNAME", "TXT", "MX", "SOA"}
+	recordTypes := []string{"A", "AAAA", "NS", "CNAME", "TXT", "MX", "SOA", "SRV", "SVCB", "HTTPS", "TLSA", "SSHFP", "NAPTR", "URI", "LOC", "ALIAS"}
 	for _, t := range recordTypes {
 		categorizedRecords[t] = make(map[string][]rr)
 	}
 
-	for name, records := range zone {
-		for _, record := range records {
-			var typeStr string
-			switch record.Type_ {
-			case type_a:
-				typeStr = "A"
-			case type_aaaa:
-				typeStr = "AAAA"
-			case type_ns:
-				typeStr = "NS"
-			case type_cname:
-				typeStr = "CNAME"
-			case type_txt:
-				typeStr = "TXT"
-			case type_mx:
-				typeStr = "MX"
-			case type_soa:
-				typeStr = "SOA"
-			default:
-				typeStr = "Other"
-			}
+	for _, name := range v.zone.names() {
+		for _, record := range v.zone.get(name) {
+			typeStr := typeToString(record.Type_)
 			if _, ok := categorizedRecords[typeStr]; !ok {
 				categorizedRecords[typeStr] = make(map[string][]rr)
 			}
@@ -387,10 +151,18 @@ func handle_index(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	var viewNames []string
+	for _, v := range allViews() {
+		viewNames = append(viewNames, v.Name)
+	}
 	data := struct {
-		Records   map[string]map[string][]rr
-		Analytics map[string]map[string]int
-	}{categorizedRecords, stats}
+		View        string
+		Views       []string
+		Records     map[string]map[string][]rr
+		Analytics   map[string]map[string]int
+		Notify      []notifyState
+		Secondaries []secondaryState
+	}{v.Name, viewNames, categorizedRecords, stats, notifyStatus(), secondaryStatus()}
 
 	// Debug: Log the records and analytics being passed to the template
 	log.Printf("DEBUG: Web UI Records: %+v\n", data.Records)
@@ -414,7 +186,19 @@ func basic_auth(next http.HandlerFunc) http.HandlerFunc {
 }
 
 func quoteTXT(s string) string {
-	return `"` + s + `"`
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// splitRdata splits a value typed into the web form into rdata fields, and
+// whether each was quoted. an unquoted TXT value is taken as one string, like
+// it always was
+func splitRdata(t uint16, value string) ([]string, []bool) {
+	value = strings.TrimSpace(value)
+	if t == type_txt && !strings.HasPrefix(value, `"`) {
+		return []string{value}, []bool{true}
+	}
+	return zoneFields(value)
 }
 
 func unquoteTXT(s string) string {
@@ -0,0 +1,168 @@
+// zone transfer access control: who may AXFR/IXFR which zone
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// xfrACL says who may transfer a zone and the zones below it, unless a closer
+// zone has a list of its own. the rules are checked in order and the first
+// one that matches decides, a request no rule matches is refused. a rule is
+// one or more terms that all have to match:
+//
+//	"192.0.2.0/24", "2001:db8::/32", "192.0.2.7"   the client's address
+//	"key ns2-key."                                  signed with that TSIG key
+//	"any"                                           everyone
+//
+// a "!" in front makes the rule a deny, eg "!192.0.2.66" or
+// "10.0.0.0/8 key ns2-key.". Zone "." covers every zone
+type xfrACL struct {
+	Zone  string
+	Rules []string
+
+	rules []xfrRule
+}
+
+type xfrRule struct {
+	text string
+	deny bool
+	net  *net.IPNet // nil for any address
+	key  string     // "" for signed or not
+}
+
+// per-zone transfer ACLs. zones that have none fall back to the secondaries
+// from setupAXFR
+var xfrACLs []*xfrACL
+
+// transfer ACLs config (to call while dns startup, after setupAXFR)
+func setupXFRACLs(acls ...xfrACL) error {
+	var out []*xfrACL
+	for _, a := range acls {
+		a := a
+		if a.Zone == "" {
+			return errors.New("transfer ACL needs a zone")
+		}
+		a.Zone = fqdn(strings.ToLower(a.Zone))
+		for _, text := range a.Rules {
+			r, err := parseXFRRule(text)
+			if err != nil {
+				return fmt.Errorf("transfer ACL for %s: %v", a.Zone, err)
+			}
+			a.rules = append(a.rules, r)
+		}
+		out = append(out, &a)
+	}
+	xfrACLs = out
+	return nil
+}
+
+// parseXFRRule parses one rule of an xfrACL
+func parseXFRRule(text string) (xfrRule, error) {
+	r := xfrRule{text: text}
+	s := strings.TrimSpace(text)
+	if strings.HasPrefix(s, "!") {
+		r.deny = true
+		s = s[1:]
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return r, fmt.Errorf("empty rule %q", text)
+	}
+	anyTerm := false
+	for i := 0; i < len(fields); i++ {
+		switch f := strings.ToLower(fields[i]); {
+		case f == "any":
+			anyTerm = true
+		case f == "key":
+			if i+1 == len(fields) || r.key != "" {
+				return r, fmt.Errorf("rule %q: key needs one key name", text)
+			}
+			i++
+			r.key = fqdn(strings.ToLower(fields[i]))
+		default:
+			if r.net != nil {
+				return r, fmt.Errorf("rule %q: more than one address", text)
+			}
+			n, err := parsePrefix(f)
+			if err != nil {
+				return r, fmt.Errorf("rule %q: %v", text, err)
+			}
+			r.net = n
+		}
+	}
+	if anyTerm && (r.net != nil || r.key != "") {
+		return r, fmt.Errorf("rule %q: any goes on its own", text)
+	}
+	return r, nil
+}
+
+// parsePrefix parses a CIDR prefix, or a single address as a prefix of just it
+func parsePrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// matches reports whether the rule applies to a client, keyName being the
+// verified TSIG key of its request ("" for unsigned)
+func (r xfrRule) matches(client net.IP, keyName string) bool {
+	if r.net != nil && (client == nil || !r.net.Contains(client)) {
+		return false
+	}
+	return r.key == "" || strings.EqualFold(r.key, fqdn(keyName))
+}
+
+// xfrACLFor finds the ACL for zone: the one of the closest enclosing zone, or
+// one made from the setupAXFR secondaries when no zone has its own
+func xfrACLFor(zone string) *xfrACL {
+	var found *xfrACL
+	for _, a := range xfrACLs {
+		if isBelow(zone, a.Zone) && (found == nil || isBelow(a.Zone, found.Zone)) {
+			found = a
+		}
+	}
+	if found != nil {
+		return found
+	}
+	a := &xfrACL{Zone: "."}
+	for _, ip := range axfrConf.Secondaries {
+		r, err := parseXFRRule(ip)
+		if err != nil {
+			continue
+		}
+		if keys := tsigKeys(); len(keys) > 0 {
+			// with keys configured the request has to be signed with one of them
+			for _, k := range keys {
+				kr := r
+				kr.key = fqdn(strings.ToLower(k.Name))
+				a.rules = append(a.rules, kr)
+			}
+			continue
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a
+}
+
+// allows checks a transfer request against the ACL. it also returns the rule
+// that decided, "" when none matched
+func (a *xfrACL) allows(client net.IP, keyName string) (bool, string) {
+	for _, r := range a.rules {
+		if r.matches(client, keyName) {
+			return !r.deny, r.text
+		}
+	}
+	return false, ""
+}
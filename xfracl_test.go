@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXFRACL(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+		"internal.example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"example.org. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+	)
+	analyticsFile = t.TempDir() + "/analytics.log"
+	setupAXFR([]string{"127.0.0.1"}, []tsigKey{{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256}})
+	t.Cleanup(func() { setupXFRACLs() })
+	err := setupXFRACLs(
+		xfrACL{Zone: "example.com.", Rules: []string{"!192.0.2.66", "192.0.2.0/24", "2001:db8::/32", "key axfr-key."}},
+		xfrACL{Zone: "internal.example.com", Rules: []string{"10.0.0.0/8 key axfr-key."}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("testkey")
+	for _, tc := range []struct {
+		zone, client string
+		signed       bool
+		allowed      bool
+	}{
+		{"example.com.", "192.0.2.10", false, true},
+		{"example.com.", "192.0.2.66", true, false}, // the deny comes first
+		{"example.com.", "2001:db8::53", false, true},
+		{"example.com.", "203.0.113.1", false, false},
+		{"example.com.", "203.0.113.1", true, true},
+		{"internal.example.com.", "10.1.1.1", true, true},
+		{"internal.example.com.", "10.1.1.1", false, false},
+		{"internal.example.com.", "192.0.2.10", true, false}, // closest zone's rules only
+		// no ACL of its own: the setupAXFR secondaries, signed
+		{"example.org.", "127.0.0.1", true, true},
+		{"example.org.", "127.0.0.1", false, false},
+		{"example.org.", "192.0.2.10", true, false},
+	} {
+		req := testQuery(tc.zone, 252)
+		if tc.signed {
+			req = signedAXFR(tc.zone, "axfr-key.", secret, time.Now(), 32)
+		}
+		xfr, resp := checkXFR(tc.client, req)
+		if tc.allowed {
+			if xfr == nil {
+				t.Errorf("%s from %s (signed %v) denied", tc.zone, tc.client, tc.signed)
+			}
+			continue
+		}
+		msg, err := parse_full_msg(resp)
+		if xfr != nil || err != nil || msg.Hdr.Flags&rcode_mask != rcode_refused {
+			t.Errorf("%s from %s (signed %v) not refused: %+v %v", tc.zone, tc.client, tc.signed, msg, err)
+		}
+	}
+	log, _ := os.ReadFile(analyticsFile)
+	if !strings.Contains(string(log), `"type":"refused","name":"example.com. AXFR from 192.0.2.66"`) {
+		t.Errorf("denial not in analytics:\n%s", log)
+	}
+
+	for _, bad := range []string{"", "!", "key", "10.0.0.0/8 10.1.0.0/16", "any key axfr-key.", "10.0.0.300"} {
+		if err := setupXFRACLs(xfrACL{Zone: "example.com.", Rules: []string{bad}}); err == nil {
+			t.Errorf("rule %q accepted", bad)
+		}
+	}
+}
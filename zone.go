@@ -3,26 +3,50 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
-	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// in-memory zone map
-var zone = make(map[string][]rr)
+// in-memory zone data
+var zone = newZoneTree()
 
 // load zone file
 // parseZoneLine splits a zone file line into fields, handling quoted strings for TXT records
 func parseZoneLine(line string) []string {
+	fields, _ := zoneFields(line)
+	return fields
+}
+
+// zoneFields is parseZoneLine that also reports which fields were quoted. an
+// unquoted \# keeps its backslash: it is the RFC 3597 marker, not text
+func zoneFields(line string) ([]string, []bool) {
 	var fields []string
-	var buf strings.Builder
+	var quotedFields []bool
+	var buf, raw strings.Builder
 	inQuotes := false
+	quoted := false // keeps "" as an empty field instead of dropping it
 	escaped := false
+	flush := func() {
+		field := buf.String()
+		if !quoted && raw.String() == `\#` {
+			field = `\#`
+		}
+		fields = append(fields, field)
+		quotedFields = append(quotedFields, quoted)
+		buf.Reset()
+		raw.Reset()
+		quoted = false
+	}
 	for i, r := range line {
+		if inQuotes || (r != ' ' && r != '\t') || escaped {
+			raw.WriteRune(r)
+		}
 		switch {
 		case escaped:
 			buf.WriteRune(r)
@@ -31,25 +55,25 @@ func parseZoneLine(line string) []string {
 			escaped = true
 		case r == '"':
 			inQuotes = !inQuotes
+			quoted = true
 		case r == ' ' || r == '\t':
 			if inQuotes {
 				buf.WriteRune(r)
-			} else if buf.Len() > 0 {
-				fields = append(fields, buf.String())
-				buf.Reset()
+			} else if buf.Len() > 0 || quoted {
+				flush()
 			}
 		default:
 			buf.WriteRune(r)
 		}
 		// If last character, flush
-		if i == len(line)-1 && buf.Len() > 0 {
-			fields = append(fields, buf.String())
+		if i == len(line)-1 && (buf.Len() > 0 || quoted) {
+			flush()
 		}
 	}
-	return fields
+	return fields, quotedFields
 }
 
-func load_zone(path string) error {
+func load_zone(z *zoneTree, path string) error {
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -62,207 +86,223 @@ func load_zone(path string) error {
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		parts := parseZoneLine(line)
-		if len(parts) < 4 {
-			continue
-		}
-		name := strings.ToLower(parts[0])
-		if !strings.HasSuffix(name, ".") {
-			name += "." //fqdn
-		}
-		typeStr := strings.ToUpper(parts[1])
-		value := parts[2]
-		ttl, _ := strconv.Atoi(parts[3])
-		var r rr
-		r.Name = name
-		r.Class = class_in
-		r.TTL = uint32(ttl)
-		switch typeStr {
-		case "A":
-			r.Type_ = type_a
-			ip := net.ParseIP(value).To4()
-			if ip == nil {
-				continue
-			}
-			r.Rdata = ip
-		case "AAAA":
-			r.Type_ = type_aaaa
-			ip := net.ParseIP(value).To16()
-			if ip == nil || ip.To4() != nil {
-				continue
+		if strings.HasPrefix(line, "$ORDER") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				err = fmt.Errorf("expected $ORDER <name> <policy>")
+			} else {
+				err = z.setOrderPolicy(fields[1], fields[2])
 			}
-			r.Rdata = ip
-		case "NS":
-			r.Type_ = type_ns
-			buf := &strings.Builder{}
-			labels := strings.Split(value, ".")
-			for _, label := range labels {
-				if label == "" {
-					continue // skip empty labels (from trailing dot)
-					//> NS RDATA: A <domain-name> which specifies a host which should be authoritative for the specified class and domain.
-					// The domain name must be encoded as a sequence of labels ending with a single zero byte.
-				}
-				buf.WriteByte(byte(len(label)))
-				buf.WriteString(label)
-			}
-			buf.WriteByte(0)
-			r.Rdata = []byte(buf.String())
-		case "CNAME":
-			r.Type_ = type_cname
-			buf := &strings.Builder{}
-			labels := strings.Split(value, ".")
-			for _, label := range labels {
-				if label == "" {
-					continue // skip empty labels (from trailing dot)
-				}
-				buf.WriteByte(byte(len(label)))
-				buf.WriteString(label)
-			}
-			buf.WriteByte(0)
-			r.Rdata = []byte(buf.String())
-		case "TXT":
-			r.Type_ = type_txt
-			txtVal := unquoteTXT(value)
-			if len(txtVal) > 255 {
-				continue
-			}
-			r.Rdata = append([]byte{byte(len(txtVal))}, []byte(txtVal)...)
-		case "MX":
-			r.Type_ = type_mx
-			parts := strings.Fields(value)
-			if len(parts) != 2 {
-				continue
-			}
-			preference, err := strconv.Atoi(parts[0])
 			if err != nil {
-				continue
+				log.Printf("zone: skipping line %q: %v", line, err)
 			}
-			exchange := parts[1]
-			if !strings.HasSuffix(exchange, ".") {
-				exchange += "."
+			continue
+		}
+		line, options := splitComment(line)
+		r, err := parseRecord(line)
+		if err == nil {
+			err = applyRecordOptions(&r, options)
+		}
+		if err != nil {
+			log.Printf("zone: skipping line %q: %v", line, err)
+			continue
+		}
+		z.add(r)
+		log.Printf("Loaded record: name=%s type=%d class=%d ttl=%d rdata=%v", r.Name, r.Type_, r.Class, r.TTL, r.Rdata)
+	}
+	return scanner.Err()
+}
+
+// splitComment cuts a zone line at the first ';' outside quotes. record options
+// go in the comment as key=value, eg "www.example.com. A 192.0.2.1 300 ; weight=3"
+func splitComment(line string) (string, string) {
+	inQuotes, escaped := false, false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ';' && !inQuotes:
+			return strings.TrimSpace(line[:i]), line[i+1:]
+		}
+	}
+	return line, ""
+}
+
+// applyRecordOptions sets the key=value options (and the backup flag) from a
+// record's comment. other words, and keys that aren't options, are just
+// comment text
+func applyRecordOptions(r *rr, comment string) error {
+	check := &healthCheck{}
+	for _, f := range strings.Fields(comment) {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			if strings.ToLower(f) == "backup" {
+				r.Backup = true
 			}
-			r.Preference = uint16(preference)
-			r.Exchange = exchange
-			// Also store Rdata for wire format if needed elsewhere, though not strictly for template
-			buf := &bytes.Buffer{}
-			binary.Write(buf, binary.BigEndian, uint16(preference))
-			write_name(buf, exchange)
-			r.Rdata = buf.Bytes()
+			continue
 		}
-		// SOA support
-		if typeStr == "SOA" && len(parts) >= 10 {
-			r.Type_ = type_soa
-			// SOA: <name> SOA <mname> <rname> <serial> <refresh> <retry> <expire> <minimum> <ttl>
-			mname := parts[2]
-			rname := parts[3]
-			serial, _ := strconv.ParseUint(parts[4], 10, 32)
-			refresh, _ := strconv.ParseUint(parts[5], 10, 32)
-			retry, _ := strconv.ParseUint(parts[6], 10, 32)
-			expire, _ := strconv.ParseUint(parts[7], 10, 32)
-			minimum, _ := strconv.ParseUint(parts[8], 10, 32)
-			r.TTL = uint32(ttl)
-			// Encode SOA RDATA to wire format
-			buf := &strings.Builder{}
-			labels := strings.Split(mname, ".")
-			for _, label := range labels {
-				if label == "" {
-					continue // skip empty labels (from trailing dot)
-				}
-				buf.WriteByte(byte(len(label)))
-				buf.WriteString(label)
+		var err error
+		switch strings.ToLower(key) {
+		case "weight":
+			var w uint64
+			w, err = strconv.ParseUint(value, 10, 16)
+			if err == nil && w == 0 {
+				err = errors.New("weight must be at least 1")
 			}
-			buf.WriteByte(0)
-			labels = strings.Split(rname, ".")
-			for _, label := range labels {
-				if label == "" {
-					continue // skip empty labels (from trailing dot)
-				}
-				buf.WriteByte(byte(len(label)))
-				buf.WriteString(label)
+			r.Weight = uint16(w)
+		case "check":
+			check.Kind = strings.ToLower(value)
+		case "port":
+			var p uint64
+			p, err = strconv.ParseUint(value, 10, 16)
+			check.Port = int(p)
+		case "path":
+			check.Path = value
+		case "cmd":
+			check.Cmd = value
+		case "interval":
+			check.Interval, err = time.ParseDuration(value)
+			if err == nil && check.Interval < time.Second {
+				err = errors.New("interval must be at least 1s")
 			}
-			buf.WriteByte(0)
-			// 5x 32-bit fields
-			rdata := make([]byte, 20)
-			put32 := func(i int, v uint32) {
-				rdata[i] = byte(v >> 24)
-				rdata[i+1] = byte(v >> 16)
-				rdata[i+2] = byte(v >> 8)
-				rdata[i+3] = byte(v)
+		case "timeout":
+			check.Timeout, err = time.ParseDuration(value)
+		}
+		if err != nil {
+			return fmt.Errorf("bad %s %q: %v", key, value, err)
+		}
+	}
+	if *check == (healthCheck{}) {
+		return nil
+	}
+	if r.Type_ != type_a && r.Type_ != type_aaaa {
+		return errors.New("health checks only work on A/AAAA records")
+	}
+	if err := check.validate(); err != nil {
+		return err
+	}
+	r.Check = check
+	return nil
+}
+
+// recordOptions is the reverse of applyRecordOptions, "" when there are none
+func recordOptions(r rr) string {
+	var opts []string
+	if r.Weight != 0 {
+		opts = append(opts, "weight="+strconv.Itoa(int(r.Weight)))
+	}
+	if r.Check != nil {
+		opts = append(opts, r.Check.String())
+	}
+	if r.Backup {
+		opts = append(opts, "backup")
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return " ; " + strings.Join(opts, " ")
+}
+
+// findZoneApex returns the closest enclosing name with an SOA record, or "" if
+// the name is not inside any zone we are authoritative for
+func (z *zoneTree) findZoneApex(name string) string {
+	name = fqdn(strings.ToLower(name))
+	for {
+		for _, r := range z.get(name) {
+			if r.Type_ == type_soa {
+				return name
 			}
-			put32(0, uint32(serial))
-			put32(4, uint32(refresh))
-			put32(8, uint32(retry))
-			put32(12, uint32(expire))
-			put32(16, uint32(minimum))
-			r.Rdata = append([]byte(buf.String()), rdata...)
-			r.SOA = &soaRdata{
-				MName:   mname,
-				RName:   rname,
-				Serial:  uint32(serial),
-				Refresh: uint32(refresh),
-				Retry:   uint32(retry),
-				Expire:  uint32(expire),
-				Minimum: uint32(minimum),
+		}
+		if name == "." {
+			return ""
+		}
+		name = parentName(name)
+	}
+}
+
+// findZoneCut returns the delegation point above or at name: the highest name
+// below the zone apex that has NS records but no SOA. data at or below a cut
+// belongs to the child zone and is only served as a referral
+func (z *zoneTree) findZoneCut(name string) string {
+	name = fqdn(strings.ToLower(name))
+	apex := z.findZoneApex(name)
+	if apex == "" || name == apex {
+		return ""
+	}
+	// collect the ancestors between the apex and name, nearest the apex last
+	var chain []string
+	for n := name; n != apex; {
+		chain = append(chain, n)
+		n = parentName(n)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, r := range z.get(chain[i]) {
+			if r.Type_ == type_ns {
+				return chain[i]
 			}
 		}
-		zone[name] = append(zone[name], r)
-		log.Printf("Loaded record: name=%s type=%d class=%d ttl=%d rdata=%v", r.Name, r.Type_, r.Class, r.TTL, r.Rdata)
 	}
-	return scanner.Err()
+	return ""
+}
+
+// isAuthoritative reports whether we hold the authoritative data for name:
+// inside one of our zones and not below a delegation
+func (z *zoneTree) isAuthoritative(name string) bool {
+	return z.findZoneApex(name) != "" && z.findZoneCut(name) == ""
 }
 
 // save zone file
-func save_zone(path string) error {
+func save_zone(z *zoneTree, path string) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	for name, records := range zone {
-		for _, r := range records {
-			var typ, val string
-			switch r.Type_ {
-			case type_a:
-				typ = "A"
-				val = net.IP(r.Rdata).String()
-			case type_aaaa:
-				typ = "AAAA"
-				val = net.IP(r.Rdata).String()
-			case type_ns:
-				typ = "NS"
-				val = decode_name(r.Rdata)
-			case type_cname:
-				typ = "CNAME"
-				val = decode_name(r.Rdata)
-			case type_txt:
-				typ = "TXT"
-				if len(r.Rdata) > 1 {
-					val = quoteTXT(string(r.Rdata[1:]))
-				}
-			case type_mx:
-				typ = "MX"
-				if len(r.Rdata) > 2 {
-					preference := int(r.Rdata[0])<<8 | int(r.Rdata[1])
-					exchange := decode_name(r.Rdata[2:])
-					val = strconv.Itoa(preference) + " " + exchange
-				}
-			}
-			if r.Type_ == type_soa && r.SOA != nil {
-				typ = "SOA"
-				val = r.SOA.MName + " " + r.SOA.RName + " " + strconv.FormatUint(uint64(r.SOA.Serial), 10) + " " +
-					strconv.FormatUint(uint64(r.SOA.Refresh), 10) + " " +
-					strconv.FormatUint(uint64(r.SOA.Retry), 10) + " " +
-					strconv.FormatUint(uint64(r.SOA.Expire), 10) + " " +
-					strconv.FormatUint(uint64(r.SOA.Minimum), 10)
-			}
-			if typ != "" {
-				f.WriteString(name + " " + typ + " " + val + " " + strconv.Itoa(int(r.TTL)) + "\n")
-			}
+	for _, line := range z.orderPolicyLines() {
+		f.WriteString(line + "\n")
+	}
+	for _, name := range z.names() {
+		if secondaryFor(z, name) != nil {
+			continue // kept in the secondary zone's own file
+		}
+		for _, r := range z.get(name) {
+			f.WriteString(zoneLine(r) + recordOptions(r) + "\n")
 		}
 	}
 	return nil
 }
 
+// zoneLine is a record as a zone file line, without options
+func zoneLine(r rr) string {
+	return r.Name + " " + typeToString(r.Type_) + " " + formatRdata(r.Type_, r.Rdata) + " " + strconv.Itoa(int(r.TTL))
+}
+
+// saveRecords writes records to a zone file of their own. the file is
+// written next to path and renamed over it, so a reader never sees half a zone
+func saveRecords(path string, records []rr) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range records {
+		w.WriteString(zoneLine(r) + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 // Helper to decode SOA RDATA from wire format
 
 // decode dns name from rdata
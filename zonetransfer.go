@@ -2,11 +2,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"io"
 	"log"
@@ -23,13 +25,14 @@ const (
 )
 
 type tsigKey struct {
-	Name      string // FQDN
-	Secret    string // base64
-	Algorithm string // from above like TSIG_HMAC_SHA256
+	Name      string   // FQDN
+	Secret    string   // base64
+	Algorithm string   // from above like TSIG_HMAC_SHA256
+	Uses      []string // what it may be used for (see keys.go), empty for everything
 }
 
 type axfrConfig struct {
-	Secondaries []string // allowed IPs
+	Secondaries []string // allowed addresses or prefixes, for zones without an ACL of their own (see xfracl.go)
 	TSIGKeys    []tsigKey
 }
 
@@ -38,12 +41,14 @@ var axfrConf axfrConfig
 // AXFR config (to call while dns startup)
 func setupAXFR(secondaries []string, keys []tsigKey) {
 	axfrConf.Secondaries = secondaries
+	keysMu.Lock()
 	axfrConf.TSIGKeys = keys
+	keysMu.Unlock()
 }
 
 // find TSIG key by name
 func getTSIGKey(name string) *tsigKey {
-	for _, k := range axfrConf.TSIGKeys {
+	for _, k := range tsigKeys() {
 		if strings.EqualFold(k.Name, name) {
 			return &k
 		}
@@ -192,159 +197,496 @@ func writeNameTo(b *strings.Builder, name string) error {
 	return nil
 }
 
-// Parse TSIG RR from DNS message (placeholder)
-func parseTSIG(msg []byte) (*tsigRecord, error) {
-	// Parse TSIG RR from message (see RFC 2845)
-	return nil, nil
-}
+// TSIG errors (RFC 8945 section 3), sent in the TSIG RR with rcode NOTAUTH
+const (
+	tsig_badsig   = 16
+	tsig_badkey   = 17
+	tsig_badtime  = 18
+	tsig_badtrunc = 22
+)
 
-// AXFR handler (TCP only)
-func handleAXFR(conn net.Conn, remoteIP string) {
-	defer conn.Close()
-	allowed := false
-	for _, ip := range axfrConf.Secondaries {
-		if ip == remoteIP {
-			allowed = true
-			break
+// parseTSIG finds the TSIG RR of a message. it has to be the last additional
+// record (RFC 8945 section 5.1). returns nil when the message isn't signed,
+// otherwise the record and the offset it starts at
+func parseTSIG(msg []byte) (*tsigRecord, int, error) {
+	if len(msg) < 12 {
+		return nil, 0, errors.New("packet too short")
+	}
+	var hdr dns_header
+	r := bytes.NewReader(msg)
+	binary.Read(r, binary.BigEndian, &hdr)
+	for i := 0; i < int(hdr.Qdcount); i++ {
+		if _, err := read_name(r, msg); err != nil {
+			return nil, 0, err
+		}
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, 0, err
 		}
 	}
-	if !allowed {
-		log.Printf("AXFR denied for %s", remoteIP)
-		return
+	total := int(hdr.Ancount) + int(hdr.Nscount) + int(hdr.Arcount)
+	for i := 0; i < total; i++ {
+		start := len(msg) - r.Len()
+		name, err := read_name(r, msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		var fixed struct {
+			Type_ uint16
+			Class uint16
+			TTL   uint32
+			Len   uint16
+		}
+		if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+			return nil, 0, err
+		}
+		if r.Len() < int(fixed.Len) {
+			return nil, 0, errors.New("rdata runs past end of message")
+		}
+		rdStart := len(msg) - r.Len()
+		r.Seek(int64(fixed.Len), io.SeekCurrent)
+		if fixed.Type_ != type_tsig {
+			continue
+		}
+		if i != total-1 || hdr.Arcount == 0 || fixed.Class != 255 {
+			return nil, 0, errors.New("TSIG is not the last record")
+		}
+		t, err := parseTSIGRdata(msg, rdStart, int(fixed.Len))
+		if err != nil {
+			return nil, 0, err
+		}
+		t.Name = fqdn(name)
+		return t, start, nil
 	}
+	return nil, 0, nil
+}
 
-	// Read 2-byte length prefix, then DNS message
-	lenBuf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, lenBuf); err != nil {
-		log.Printf("AXFR: failed to read length: %v", err)
-		return
+// parseTSIGRdata decodes the TSIG rdata at msg[off:off+n]
+func parseTSIGRdata(msg []byte, off, n int) (*tsigRecord, error) {
+	r := bytes.NewReader(msg[:off+n])
+	r.Seek(int64(off), io.SeekStart)
+	alg, err := read_name(r, msg)
+	if err != nil {
+		return nil, err
 	}
-	msgLen := int(lenBuf[0])<<8 | int(lenBuf[1])
-	if msgLen < 12 {
-		log.Printf("AXFR: message too short")
-		return
+	t := &tsigRecord{Algorithm: fqdn(alg)}
+	var fixed struct {
+		TimeHi  uint16
+		TimeLo  uint32
+		Fudge   uint16
+		MACSize uint16
 	}
-	msgBuf := make([]byte, msgLen)
-	if _, err := io.ReadFull(conn, msgBuf); err != nil {
-		log.Printf("AXFR: failed to read message: %v", err)
-		return
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return nil, err
+	}
+	t.TimeSigned = uint64(fixed.TimeHi)<<32 | uint64(fixed.TimeLo)
+	t.Fudge = fixed.Fudge
+	t.MAC = make([]byte, fixed.MACSize)
+	if _, err := io.ReadFull(r, t.MAC); err != nil {
+		return nil, err
+	}
+	var tail struct {
+		OrigID   uint16
+		Error    uint16
+		OtherLen uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &tail); err != nil {
+		return nil, err
+	}
+	t.OrigID, t.Error = tail.OrigID, tail.Error
+	t.OtherData = make([]byte, tail.OtherLen)
+	if _, err := io.ReadFull(r, t.OtherData); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("trailing data in TSIG rdata")
+	}
+	return t, nil
+}
+
+// tsigVariables are the TSIG fields covered by the MAC (RFC 8945 section
+// 4.3.3). timersOnly is for the later messages of a multi-message response,
+// which only cover the time signed and fudge
+func tsigVariables(t *tsigRecord, timersOnly bool) []byte {
+	buf := &bytes.Buffer{}
+	if !timersOnly {
+		write_name(buf, strings.ToLower(t.Name))
+		binary.Write(buf, binary.BigEndian, uint16(255)) // CLASS ANY
+		binary.Write(buf, binary.BigEndian, uint32(0))   // TTL
+		write_name(buf, strings.ToLower(t.Algorithm))
+	}
+	binary.Write(buf, binary.BigEndian, uint16(t.TimeSigned>>32))
+	binary.Write(buf, binary.BigEndian, uint32(t.TimeSigned))
+	binary.Write(buf, binary.BigEndian, t.Fudge)
+	if !timersOnly {
+		binary.Write(buf, binary.BigEndian, t.Error)
+		binary.Write(buf, binary.BigEndian, uint16(len(t.OtherData)))
+		buf.Write(t.OtherData)
+	}
+	return buf.Bytes()
+}
+
+// tsigDigest is what the MAC is computed over: the prior MAC (request MAC for
+// a response, previous message's MAC in a multi-message response) with its
+// length, the message as it was before the TSIG was added, then the variables
+func tsigDigest(prior []byte, msg []byte, t *tsigRecord, timersOnly bool) []byte {
+	var out []byte
+	if prior != nil {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(prior)))
+		out = append(out, prior...)
 	}
+	out = append(out, msg...)
+	return append(out, tsigVariables(t, timersOnly)...)
+}
 
-	// Parse header and question
-	hdrIn, q, err := parse_dns_msg(msgBuf)
+// verifyTSIG checks the TSIG of a request the way RFC 8945 section 5.2 says,
+// in order: key and algorithm, MAC, then time. it returns the TSIG (nil when
+// the request is unsigned), the key that signed it, and the TSIG error to
+// answer with, 0 when the request verified. err is a malformed TSIG (FORMERR)
+func verifyTSIG(msg []byte, now time.Time) (*tsigRecord, *tsigKey, uint16, error) {
+	t, start, err := parseTSIG(msg)
+	if err != nil || t == nil {
+		return nil, nil, 0, err
+	}
+	key := getTSIGKey(t.Name)
+	if key == nil || !strings.EqualFold(fqdn(key.Algorithm), t.Algorithm) {
+		return t, nil, tsig_badkey, nil
+	}
+	// the message as it was signed: without the TSIG, ARCOUNT one lower and
+	// the original id
+	signed := append([]byte(nil), msg[:start]...)
+	binary.BigEndian.PutUint16(signed, t.OrigID)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])-1)
+	mac, err := tsigMAC(key.Algorithm, key.Secret, tsigDigest(nil, signed, t, false))
+	if err != nil {
+		return t, nil, tsig_badkey, nil
+	}
+	// truncated MACs (RFC 8945 section 5.2.2.1) shorter than this are malformed
+	if len(t.MAC) > len(mac) || len(t.MAC) < max(10, len(mac)/2) {
+		return nil, nil, 0, errors.New("bad TSIG MAC size")
+	}
+	if !hmac.Equal(t.MAC, mac[:len(t.MAC)]) {
+		return t, nil, tsig_badsig, nil
+	}
+	if len(t.MAC) < len(mac) {
+		return t, key, tsig_badtrunc, nil // we don't accept truncation
+	}
+	if d := now.Unix() - int64(t.TimeSigned); d > int64(t.Fudge) || -d > int64(t.Fudge) {
+		return t, key, tsig_badtime, nil
+	}
+	return t, key, 0, nil
+}
+
+// signTSIG appends a TSIG RR to msg, signed with key over prior (see
+// tsigDigest) and t's variables, and bumps ARCOUNT. t.MAC is set to the new MAC
+func signTSIG(msg []byte, key *tsigKey, prior []byte, t *tsigRecord, timersOnly bool) ([]byte, error) {
+	mac, err := tsigMAC(key.Algorithm, key.Secret, tsigDigest(prior, msg, t, timersOnly))
+	if err != nil {
+		return nil, err
+	}
+	t.MAC = mac
+	return appendTSIG(msg, t)
+}
+
+// appendTSIG adds t as the last additional record of msg
+func appendTSIG(msg []byte, t *tsigRecord) ([]byte, error) {
+	tsigBuf := &strings.Builder{}
+	if err := writeTSIG(tsigBuf, t); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte(nil), msg...), tsigBuf.String()...)
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, nil
+}
+
+// tsigErrorResponse is the NOTAUTH answer to a request whose TSIG failed
+// (RFC 8945 section 5.3.2). BADKEY and BADSIG go back unsigned since we can't
+// prove anything with the key; BADTIME and BADTRUNC are signed, BADTIME also
+// carries our clock in the other data so the client can see the skew
+func tsigErrorResponse(hdr dns_header, q dns_question, req *tsigRecord, key *tsigKey, tsigErr uint16, now time.Time) ([]byte, error) {
+	msg, err := build_message(hdr, q, queryResult{Rcode: rcode_notauth})
 	if err != nil {
+		return nil, err
+	}
+	t := &tsigRecord{
+		Name:       req.Name,
+		Algorithm:  req.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      req.Fudge,
+		OrigID:     hdr.Id,
+		Error:      tsigErr,
+	}
+	if key == nil || tsigErr == tsig_badsig || tsigErr == tsig_badkey {
+		return appendTSIG(msg, t)
+	}
+	if tsigErr == tsig_badtime {
+		t.TimeSigned = req.TimeSigned
+		t.OtherData = binary.BigEndian.AppendUint16(nil, uint16(now.Unix()>>32))
+		t.OtherData = binary.BigEndian.AppendUint32(t.OtherData, uint32(now.Unix()))
+	}
+	return signTSIG(msg, key, req.MAC, t, false)
+}
+
+// xfrRequest is a zone transfer request that passed the access checks
+type xfrRequest struct {
+	hdr  dns_header
+	q    dns_question
+	zone string // apex, lowercase
+	tsig *tsigRecord
+	key  *tsigKey // nil for an unsigned request
+	view *view
+	// IXFR: the serial the client has, from the SOA in its authority section
+	serial uint32
+}
+
+// checkXFR parses an AXFR/IXFR request and runs the access checks. when the
+// request may not go ahead it returns nil, with the response to send if any
+func checkXFR(remoteIP string, msgBuf []byte) (*xfrRequest, []byte) {
+	// Parse header and question
+	msg, err := parse_full_msg(msgBuf)
+	if err != nil || len(msg.Questions) != 1 {
 		log.Printf("AXFR: failed to parse DNS msg: %v", err)
-		return
+		return nil, nil
 	}
-	if q.Type_ != 252 { // AXFR QTYPE
-		log.Printf("AXFR: not an AXFR request (qtype=%d)", q.Type_)
-		return
+	req := &xfrRequest{hdr: msg.Hdr, q: msg.Questions[0]}
+	hdrIn, q := req.hdr, req.q
+	if q.Type_ != 252 && q.Type_ != 251 { // AXFR, IXFR QTYPE
+		log.Printf("AXFR: not a zone transfer request (qtype=%d)", q.Type_)
+		return nil, nil
+	}
+	errorResp := func(rcode uint16) []byte {
+		resp, _ := build_message(hdrIn, q, queryResult{Rcode: rcode})
+		return resp
 	}
 
-	// TODO: Parse and validate TSIG if present (last RR in additional section)
-	// Placeholder: no TSIG validation yet
+	reqTSIG, key, tsigErr, err := verifyTSIG(msgBuf, time.Now())
+	switch {
+	case err != nil:
+		log.Printf("AXFR: bad TSIG from %s: %v", remoteIP, err)
+		return nil, errorResp(rcode_formerr)
+	case tsigErr != 0:
+		log.Printf("AXFR: TSIG error %d from %s (key %s)", tsigErr, remoteIP, reqTSIG.Name)
+		resp, _ := tsigErrorResponse(hdrIn, q, reqTSIG, key, tsigErr, time.Now())
+		return nil, resp
+	}
+	req.tsig, req.key = reqTSIG, key
+
+	if q.Type_ == 251 {
+		// RFC 1995 section 3: the client's SOA is in the authority section
+		if len(msg.Authority) != 1 || msg.Authority[0].SOA == nil {
+			log.Printf("IXFR: request from %s without the client SOA", remoteIP)
+			return nil, errorResp(rcode_formerr)
+		}
+		req.serial = msg.Authority[0].SOA.Serial
+	}
 
-	log.Printf("AXFR request for zone %s from %s", q.Name, remoteIP)
+	log.Printf("%s request for zone %s from %s", xfrName(q.Type_), q.Name, remoteIP)
 
 	// Normalize q.Name and zone keys (ensure trailing dot, lower-case)
-	zoneKey := strings.ToLower(q.Name)
-	if !strings.HasSuffix(zoneKey, ".") {
-		zoneKey += "."
-	}
-	// Debug: print all zone keys and q.Name
-	log.Printf("AXFR: zone keys: %v, q.Name: %s, normalized: %s", keys(zone), q.Name, zoneKey)
-	soaRecs := []rr{}
-	for _, r := range zone[zoneKey] {
-		if r.Type_ == type_soa {
-			soaRecs = append(soaRecs, r)
+	req.zone = fqdn(strings.ToLower(q.Name))
+	keyName := ""
+	if key != nil {
+		keyName = key.Name
+	}
+	ok, rule := xfrACLFor(req.zone).allows(net.ParseIP(remoteIP), keyName)
+	if ok && key != nil && !keyAllows(key, keyUseTransfer) {
+		ok, rule = false, "key not for transfers"
+	}
+	if !ok {
+		if rule == "" {
+			rule = "no rule matched"
 		}
+		log.Printf("%s of %s denied for %s (key %q): %s", xfrName(q.Type_), req.zone, remoteIP, keyName, rule)
+		logAnalyticsEvent("refused", req.zone+" "+xfrName(q.Type_)+" from "+remoteIP)
+		return nil, errorResp(rcode_refused)
 	}
-	if len(soaRecs) == 0 {
-		log.Printf("AXFR: no SOA record for zone %s (normalized: %s)", q.Name, zoneKey)
-		return
+	req.view = viewFor(net.ParseIP(remoteIP), keyName)
+	if req.view == nil {
+		log.Printf("AXFR: no view for %s", remoteIP)
+		return nil, errorResp(rcode_refused)
+	}
+
+	if req.view.zone.findZoneApex(req.zone) != req.zone {
+		log.Printf("AXFR: no SOA record for zone %s (normalized: %s)", q.Name, req.zone)
+		return nil, errorResp(rcode_notauth)
 	}
-	soa := soaRecs[0]
+	return req, nil
+}
 
-	// Collect all RRs for the zone
-	allRRs := []rr{}
-	for name, recs := range zone {
-		if strings.HasSuffix(name, zoneKey) {
-			allRRs = append(allRRs, recs...)
+// records returns what the transfer sends: for IXFR the differences since the
+// client's serial when the journal has them (RFC 1995 section 4), otherwise
+// (and for AXFR, RFC 5936 section 2.2) the SOA, every other record, the SOA again
+func (req *xfrRequest) records() []rr {
+	if req.q.Type_ == 251 {
+		if recs, ok := req.view.zone.ixfrRecords(req.zone, req.serial); ok {
+			return recs
 		}
+		log.Printf("IXFR: no history for %s from serial %d, sending the whole zone", req.zone, req.serial)
+	}
+	records := req.view.zone.snapshot(req.zone)
+	if len(records) == 0 || records[0].Type_ != type_soa {
+		return nil
 	}
+	return append(records, records[0])
+}
 
-	// AXFR: send [SOA, all RRs, SOA] as separate DNS messages over TCP
-	// Each message: 2-byte length prefix + DNS message
-	msgs := [][]rr{
-		{soa},
-		allRRs,
-		{soa},
+// zone transfer handler (TCP), AXFR and IXFR. msgBuf is the request read by
+// handle_tcp_conn
+func handleAXFR(conn net.Conn, remoteIP string, msgBuf []byte) {
+	req, errResp := checkXFR(remoteIP, msgBuf)
+	if req == nil {
+		if errResp != nil {
+			write_tcp_msg(conn, errResp)
+		}
+		return
+	}
+	records := req.records()
+	if len(records) == 0 {
+		writeAXFRError(conn, req.hdr, req.q, rcode_servfail)
+		return
+	}
+	// packed into as few messages as fit
+	reserve := 0
+	if req.key != nil {
+		reserve = tsigReserve
 	}
-	tsKey := getTSIGKey("axfr-key.") // For demo: always use the configured key
+	msgs := packMessages(req.q, records, axfrMessageSize-reserve)
+	signer := newTSIGStream(req.key, req.tsig) // signs nothing for an unsigned request
 	for _, rrs := range msgs {
-		hdr := dns_header{Id: hdrIn.Id, Flags: qr_mask | aa_mask, Qdcount: 1, Ancount: uint16(len(rrs)), Nscount: 0, Arcount: 0}
-		qmsg := dns_question{Name: q.Name, Type_: 252, Class: class_in}
-		var tsigBuf *strings.Builder
-		var tsigRR *tsigRecord
-		msg, err := build_response(hdr, qmsg, rrs, nil)
+		hdr := dns_header{Id: req.hdr.Id, Flags: req.hdr.Flags}
+		msg, err := build_response(hdr, req.q, rrs, nil)
 		if err != nil {
 			log.Printf("AXFR: failed to build response: %v", err)
 			return
 		}
-
-		// If TSIG is required, append TSIG RR
-		if tsKey != nil {
-			mac, err := tsigMAC(tsKey.Algorithm, tsKey.Secret, msg)
-			if err != nil {
-				log.Printf("AXFR: TSIG signing error: %v", err)
-				return
-			}
-			tsigRR = &tsigRecord{
-				Name:       tsKey.Name,
-				Algorithm:  tsKey.Algorithm,
-				TimeSigned: uint64(timeNow()),
-				Fudge:      300,
-				MAC:        mac,
-				OrigID:     hdr.Id,
-				Error:      0,
-				OtherData:  nil,
-			}
-			tsigBuf = &strings.Builder{}
-			if err := writeTSIG(tsigBuf, tsigRR); err != nil {
-				log.Printf("AXFR: failed to encode TSIG: %v", err)
-				return
-			}
-			// Patch ARCOUNT in header (should be 1 for TSIG)
-			// For simplicity, just append TSIG RR to msg and send
-			msg = append(msg, []byte(tsigBuf.String())...)
-		}
-
-		msgLen := len(msg)
-		lenPrefix := []byte{byte(msgLen >> 8), byte(msgLen & 0xff)}
-		if _, err := conn.Write(lenPrefix); err != nil {
-			log.Printf("AXFR: failed to write length: %v", err)
+		if msg, err = signer.sign(msg, time.Now()); err != nil {
+			log.Printf("AXFR: TSIG signing error: %v", err)
 			return
 		}
-		if _, err := conn.Write(msg); err != nil {
+
+		if err := write_tcp_msg(conn, msg); err != nil {
 			log.Printf("AXFR: failed to write message: %v", err)
 			return
 		}
 	}
-	log.Printf("AXFR served to %s", remoteIP)
+	log.Printf("%s of %s served to %s: %d records in %d messages", xfrName(req.q.Type_), req.zone, remoteIP, len(records), len(msgs))
+}
+
+// answerIXFR answers an IXFR over udp. when the answer doesn't fit in 512
+// bytes only the current SOA goes back, which tells the client to retry over
+// tcp (RFC 1995 section 2)
+func answerIXFR(data []byte, client net.IP) []byte {
+	req, errResp := checkXFR(client.String(), data)
+	if req == nil {
+		return errResp
+	}
+	records := req.records()
+	if len(records) == 0 {
+		resp, _ := build_message(req.hdr, req.q, queryResult{Rcode: rcode_servfail})
+		return resp
+	}
+	for _, rrs := range [][]rr{records, records[:1]} {
+		resp, err := build_response(req.hdr, req.q, rrs, nil)
+		if err == nil {
+			resp, err = newTSIGStream(req.key, req.tsig).sign(resp, time.Now())
+		}
+		if err != nil {
+			log.Printf("IXFR: failed to build response: %v", err)
+			return nil
+		}
+		if len(resp) <= 512 {
+			return resp
+		}
+	}
+	return nil
 }
 
-// helper to get all keys from a map[string][]rr
-func keys(m map[string][]rr) []string {
-	out := make([]string, 0, len(m))
-	for k := range m {
-		out = append(out, k)
+// packMessages splits records into the answer sections of as few messages
+// as possible, each at most maxSize bytes with q as its question. a record
+// too big for maxSize on its own still gets a message of its own
+func packMessages(q dns_question, records []rr, maxSize int) [][]rr {
+	qbuf := &bytes.Buffer{}
+	write_name(qbuf, q.Name)
+	size := 12 + qbuf.Len() + 4
+	var msgs [][]rr
+	var cur []rr
+	used := size
+	for _, r := range records {
+		rbuf := &bytes.Buffer{}
+		write_rr(rbuf, r)
+		if len(cur) > 0 && (used+rbuf.Len() > maxSize || len(cur) == 65535) {
+			msgs = append(msgs, cur)
+			cur, used = nil, size
+		}
+		cur = append(cur, r)
+		used += rbuf.Len()
 	}
-	return out
+	if len(cur) > 0 {
+		msgs = append(msgs, cur)
+	}
+	return msgs
+}
+
+// tsigStream signs the messages of a response in turn (RFC 8945 section
+// 5.3.1). the first message covers the request MAC and all the TSIG
+// variables, every later one the previous message's MAC and just the timers
+type tsigStream struct {
+	key    *tsigKey
+	prior  []byte
+	id     uint16
+	signed int
 }
 
-// helper to get current unix time (seconds)
-func timeNow() int64 {
-	return time.Now().Unix()
+// newTSIGStream starts signing the response to req, which was verified with
+// key. the responses are signed with the key the client used, and only if
+// the request was signed at all
+func newTSIGStream(key *tsigKey, req *tsigRecord) *tsigStream {
+	if key == nil || req == nil {
+		return &tsigStream{}
+	}
+	return &tsigStream{key: key, prior: req.MAC, id: req.OrigID}
+}
+
+// sign returns msg with its TSIG added, or msg as is when nothing is signed
+func (s *tsigStream) sign(msg []byte, now time.Time) ([]byte, error) {
+	if s.key == nil {
+		return msg, nil
+	}
+	t := &tsigRecord{
+		Name:       fqdn(s.key.Name),
+		Algorithm:  fqdn(s.key.Algorithm),
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      300,
+		OrigID:     s.id,
+	}
+	out, err := signTSIG(msg, s.key, s.prior, t, s.signed > 0)
+	if err != nil {
+		return nil, err
+	}
+	s.prior = t.MAC
+	s.signed++
+	return out, nil
+}
+
+// largest AXFR response message (tcp allows up to 65535), edit as needed
+var axfrMessageSize = 16384
+
+// room left in each message for the TSIG RR: names, fixed fields and a
+// SHA-512 MAC with space to spare
+const tsigReserve = 256
+
+// xfrName names a transfer QTYPE for logs
+func xfrName(qtype uint16) string {
+	if qtype == 251 {
+		return "IXFR"
+	}
+	return "AXFR"
+}
+
+// writeAXFRError answers a transfer request with just an rcode
+func writeAXFRError(conn net.Conn, hdr dns_header, q dns_question, rcode uint16) {
+	if resp, err := build_message(hdr, q, queryResult{Rcode: rcode}); err == nil {
+		write_tcp_msg(conn, resp)
+	}
 }
 
-// To use: in your TCP server, on AXFR request, call handleAXFR(conn, remoteIP)
+// To use: in your TCP server, on AXFR request, call handleAXFR(conn, remoteIP, msg)
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedAXFR builds an AXFR request for name signed the way RFC 8945 section
+// 4.3 describes, written out longhand so it doesn't share code with the server
+func signedAXFR(name, keyName string, secret []byte, signed time.Time, macLen int) []byte {
+	msg := &bytes.Buffer{}
+	binary.Write(msg, binary.BigEndian, dns_header{Id: 0x4242, Qdcount: 1})
+	write_name(msg, name)
+	binary.Write(msg, binary.BigEndian, uint16(252))
+	binary.Write(msg, binary.BigEndian, uint16(class_in))
+
+	vars := &bytes.Buffer{}
+	write_name(vars, keyName)
+	vars.Write([]byte{0, 255, 0, 0, 0, 0})
+	write_name(vars, "hmac-sha256.")
+	binary.Write(vars, binary.BigEndian, uint16(signed.Unix()>>32))
+	binary.Write(vars, binary.BigEndian, uint32(signed.Unix()))
+	binary.Write(vars, binary.BigEndian, uint16(300))
+	vars.Write([]byte{0, 0, 0, 0}) // error, other len
+	h := hmac.New(sha256.New, secret)
+	h.Write(msg.Bytes())
+	h.Write(vars.Bytes())
+	mac := h.Sum(nil)[:macLen]
+
+	rdata := &bytes.Buffer{}
+	write_name(rdata, "hmac-sha256.")
+	binary.Write(rdata, binary.BigEndian, uint16(signed.Unix()>>32))
+	binary.Write(rdata, binary.BigEndian, uint32(signed.Unix()))
+	binary.Write(rdata, binary.BigEndian, uint16(300))
+	binary.Write(rdata, binary.BigEndian, uint16(len(mac)))
+	rdata.Write(mac)
+	binary.Write(rdata, binary.BigEndian, uint16(0x4242))
+	rdata.Write([]byte{0, 0, 0, 0})
+
+	out := msg.Bytes()
+	binary.BigEndian.PutUint16(out[10:], 1)
+	tsig := &bytes.Buffer{}
+	write_rr(tsig, rr{Name: keyName, Type_: type_tsig, Class: 255, Rdata: rdata.Bytes()})
+	return append(out, tsig.Bytes()...)
+}
+
+// runAXFRRaw feeds req to handleAXFR and returns every message it sent back
+func runAXFRRaw(req []byte) [][]byte {
+	client, server := net.Pipe()
+	go func() {
+		handleAXFR(server, "127.0.0.1", req)
+		server.Close()
+	}()
+	defer client.Close()
+	var out [][]byte
+	for {
+		resp, err := read_tcp_msg(client)
+		if err != nil {
+			return out
+		}
+		out = append(out, resp)
+	}
+}
+
+// runAXFR is runAXFRRaw with the messages parsed
+func runAXFR(t *testing.T, req []byte) []*dns_msg {
+	t.Helper()
+	var msgs []*dns_msg
+	for _, resp := range runAXFRRaw(req) {
+		msg, err := parse_full_msg(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// responseTSIG returns the TSIG of a response, nil if it has none
+func responseTSIG(t *testing.T, msg *dns_msg) *tsigRecord {
+	t.Helper()
+	if len(msg.Additional) == 0 || msg.Additional[len(msg.Additional)-1].Type_ != type_tsig {
+		return nil
+	}
+	r := msg.Additional[len(msg.Additional)-1]
+	tsig, err := parseTSIGRdata(r.Rdata, 0, len(r.Rdata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tsig
+}
+
+func TestAXFRTSIGVerification(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+	)
+	setupAXFR([]string{"127.0.0.1"}, []tsigKey{{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256}})
+	secret := []byte("testkey")
+	now := time.Now()
+
+	msgs := runAXFR(t, signedAXFR("example.com.", "axfr-key.", secret, now, 32))
+	if len(msgs) == 0 || msgs[0].Hdr.Flags&rcode_mask != rcode_noerror || len(msgs[0].Answer) == 0 || msgs[0].Answer[0].Type_ != type_soa {
+		t.Fatalf("signed request was not answered with the zone: %+v", msgs)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		req     []byte
+		tsigErr uint16
+		signed  bool
+	}{
+		{"wrong secret", signedAXFR("example.com.", "axfr-key.", []byte("nope"), now, 32), tsig_badsig, false},
+		{"unknown key", signedAXFR("example.com.", "other-key.", secret, now, 32), tsig_badkey, false},
+		{"old request", signedAXFR("example.com.", "axfr-key.", secret, now.Add(-time.Hour), 32), tsig_badtime, true},
+		{"truncated mac", signedAXFR("example.com.", "axfr-key.", secret, now, 16), tsig_badtrunc, true},
+	} {
+		msgs := runAXFR(t, tc.req)
+		if len(msgs) != 1 || msgs[0].Hdr.Flags&rcode_mask != rcode_notauth || len(msgs[0].Answer) != 0 {
+			t.Errorf("%s: expected one NOTAUTH response, got %+v", tc.name, msgs)
+			continue
+		}
+		tsig := responseTSIG(t, msgs[0])
+		if tsig == nil || tsig.Error != tc.tsigErr || (len(tsig.MAC) > 0) != tc.signed {
+			t.Errorf("%s: response TSIG %+v, want error %d signed=%v", tc.name, tsig, tc.tsigErr, tc.signed)
+		}
+		if tc.tsigErr == tsig_badtime && len(tsig.OtherData) != 6 {
+			t.Errorf("BADTIME should carry the server time, other data %x", tsig.OtherData)
+		}
+	}
+
+	// keys are configured, so an unsigned request is refused
+	unsigned := testQuery("example.com.", 252)
+	msgs = runAXFR(t, unsigned)
+	if len(msgs) != 1 || msgs[0].Hdr.Flags&rcode_mask != rcode_refused {
+		t.Errorf("unsigned request: %+v", msgs)
+	}
+	// a record after the TSIG is malformed
+	bad := signedAXFR("example.com.", "axfr-key.", secret, now, 32)
+	bad[11] = 2
+	bad = append(bad, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0)
+	if msgs := runAXFR(t, bad); len(msgs) != 1 || msgs[0].Hdr.Flags&rcode_mask != rcode_formerr {
+		t.Errorf("TSIG not last: %+v", msgs)
+	}
+}
+
+func TestAXFRTSIGSigning(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+	)
+	setupAXFR([]string{"127.0.0.1"}, []tsigKey{
+		{Name: "axfr-key.", Secret: "dGVzdGtleQ==", Algorithm: TSIG_HMAC_SHA256},
+		{Name: "other-key.", Secret: "b3RoZXJrZXk=", Algorithm: TSIG_HMAC_SHA256},
+	})
+	// small messages so the MACs get chained
+	axfrMessageSize = tsigReserve + 100
+	defer func() { axfrMessageSize = 16384 }()
+	req := signedAXFR("example.com.", "other-key.", []byte("otherkey"), time.Now(), 32)
+	reqTSIG, _, _ := parseTSIG(req)
+
+	resps := runAXFRRaw(req)
+	if len(resps) < 2 {
+		t.Fatalf("expected a multi-message transfer, got %d messages", len(resps))
+	}
+	prior := reqTSIG.MAC
+	for i, resp := range resps {
+		tsig, start, err := parseTSIG(resp)
+		if err != nil || tsig == nil {
+			t.Fatalf("message %d: no TSIG (%v)", i, err)
+		}
+		if tsig.Name != "other-key." || binary.BigEndian.Uint16(resp[10:]) != 1 {
+			t.Errorf("message %d: signed with %s, arcount %d", i, tsig.Name, binary.BigEndian.Uint16(resp[10:]))
+		}
+		// what the secondary computes: prior MAC, the message without its TSIG,
+		// then all the variables for the first message and the timers after that
+		unsigned := append([]byte(nil), resp[:start]...)
+		binary.BigEndian.PutUint16(unsigned[10:], 0)
+		h := hmac.New(sha256.New, []byte("otherkey"))
+		binary.Write(h, binary.BigEndian, uint16(len(prior)))
+		h.Write(prior)
+		h.Write(unsigned)
+		if i == 0 {
+			vars := &bytes.Buffer{}
+			write_name(vars, "other-key.")
+			vars.Write([]byte{0, 255, 0, 0, 0, 0})
+			write_name(vars, "hmac-sha256.")
+			h.Write(vars.Bytes())
+		}
+		binary.Write(h, binary.BigEndian, uint16(tsig.TimeSigned>>32))
+		binary.Write(h, binary.BigEndian, uint32(tsig.TimeSigned))
+		binary.Write(h, binary.BigEndian, tsig.Fudge)
+		if i == 0 {
+			h.Write([]byte{0, 0, 0, 0}) // error, other len
+		}
+		if !hmac.Equal(h.Sum(nil), tsig.MAC) {
+			t.Errorf("message %d: MAC does not verify", i)
+		}
+		prior = tsig.MAC
+	}
+
+	// unsigned requests get unsigned transfers
+	setupAXFR([]string{"127.0.0.1"}, nil)
+	for i, resp := range runAXFRRaw(testQuery("example.com.", 252)) {
+		if tsig, _, _ := parseTSIG(resp); tsig != nil {
+			t.Errorf("message %d of an unsigned transfer has a TSIG", i)
+		}
+	}
+}
+
+func TestAXFRChunking(t *testing.T) {
+	lines := []string{
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300 3600",
+		"example.com. NS ns1.example.com. 3600",
+		"sub.example.com. NS ns.sub.example.com. 3600",
+		"ns.sub.example.com. A 192.0.2.53 3600",
+		"child.example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.child.example.com. A 192.0.2.99 3600",
+	}
+	for i := 0; i < 3000; i++ {
+		lines = append(lines, "host"+strconv.Itoa(i)+".example.com. A 192.0.2."+strconv.Itoa(i%250)+" 3600")
+	}
+	testZone(t, lines...)
+	setupAXFR([]string{"127.0.0.1"}, nil)
+
+	var records []rr
+	resps := runAXFRRaw(testQuery("example.com.", 252))
+	for _, resp := range resps {
+		if len(resp) > axfrMessageSize {
+			t.Errorf("message of %d bytes, limit is %d", len(resp), axfrMessageSize)
+		}
+		msg, err := parse_full_msg(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, msg.Answer...)
+	}
+	if len(resps) < 3 {
+		t.Errorf("3000 records should not fit in %d messages", len(resps))
+	}
+	// SOA, NS, glue, the hosts, SOA; nothing from the child zone
+	if len(records) != 3005 {
+		t.Fatalf("got %d records, want 3005", len(records))
+	}
+	first, last := records[0], records[len(records)-1]
+	if first.Type_ != type_soa || last.Type_ != type_soa || first.SOA.Serial != 7 || last.SOA.Serial != 7 {
+		t.Errorf("transfer should start and end with the SOA: %+v ... %+v", first, last)
+	}
+	for _, r := range records[1 : len(records)-1] {
+		if r.Type_ == type_soa || isBelow(r.Name, "child.example.com.") {
+			t.Errorf("unexpected record %s %s in the transfer", r.Name, typeToString(r.Type_))
+		}
+	}
+}
+
+func TestZoneSnapshotDuringEdits(t *testing.T) {
+	testZone(t, "example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2000; i++ {
+			name := "h" + strconv.Itoa(i) + ".example.com."
+			zone.add(makeRR(name, type_a, 60, []byte{192, 0, 2, 1}))
+			zone.set(name, nil)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		// every name is added and removed again, a snapshot sees at most one
+		if n := len(zone.snapshot("example.com.")); n != 1 && n != 2 {
+			t.Fatalf("snapshot with %d records", n)
+		}
+	}
+}
+
+// ixfrQuery is an IXFR request from a client that has serial
+func ixfrQuery(apex string, serial uint32) []byte {
+	q := testQuery(apex, 251)
+	binary.BigEndian.PutUint16(q[8:], 1) // NSCOUNT
+	soa, _ := parseRdata(type_soa, []string{"ns1.example.com.", "hostmaster.example.com.", strconv.Itoa(int(serial)), "3600", "600", "86400", "300"})
+	buf := &bytes.Buffer{}
+	write_rr(buf, makeRR(apex, type_soa, 3600, soa))
+	return append(q, buf.Bytes()...)
+}
+
+func TestIXFR(t *testing.T) {
+	testZone(t,
+		"example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300 3600",
+		"www.example.com. A 192.0.2.1 3600",
+	)
+	setupAXFR([]string{"127.0.0.1"}, nil)
+	analyticsFile = t.TempDir() + "/analytics.log"
+	zone.change("example.com.", nil, []rr{makeRR("mail.example.com.", type_a, 3600, []byte{192, 0, 2, 25})})
+
+	answers := func(resps [][]byte) []rr {
+		var out []rr
+		for _, resp := range resps {
+			msg, err := parse_full_msg(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, msg.Answer...)
+		}
+		return out
+	}
+	// tcp, incremental: SOA 2, SOA 1, SOA 2, mail, SOA 2
+	if got := answers(runAXFRRaw(ixfrQuery("example.com.", 1))); len(got) != 5 || got[1].SOA.Serial != 1 || got[3].Name != "mail.example.com." {
+		t.Errorf("tcp ixfr: %v", describe(got))
+	}
+	// no history for serial 0: the whole zone, AXFR style
+	if got := answers(runAXFRRaw(ixfrQuery("example.com.", 0))); len(got) != 4 || got[1].Type_ == type_soa {
+		t.Errorf("ixfr without history: %v", describe(got))
+	}
+
+	client := net.ParseIP("127.0.0.1")
+	msg, err := parse_full_msg(answer_msg(ixfrQuery("example.com.", 1), client, false))
+	if err != nil || len(msg.Answer) != 5 {
+		t.Fatalf("udp ixfr: %+v %v", msg, err)
+	}
+	// doesn't fit in udp: just the SOA, so the client comes back over tcp
+	for i := 0; i < 40; i++ {
+		zone.change("example.com.", nil, []rr{makeRR("h"+strconv.Itoa(i)+".example.com.", type_a, 3600, []byte{192, 0, 2, byte(i)})})
+	}
+	msg, err = parse_full_msg(answer_msg(ixfrQuery("example.com.", 1), client, false))
+	if err != nil || len(msg.Answer) != 1 || msg.Answer[0].SOA.Serial != 42 {
+		t.Errorf("oversized udp ixfr: %+v %v", msg, err)
+	}
+	// other clients are still not allowed
+	if msg, err := parse_full_msg(answer_msg(ixfrQuery("example.com.", 1), net.ParseIP("192.0.2.200"), false)); err != nil ||
+		msg.Hdr.Flags&rcode_mask != rcode_refused || len(msg.Answer) != 0 {
+		t.Errorf("ixfr for a host that is not a secondary: %+v %v", msg, err)
+	}
+}
@@ -0,0 +1,246 @@
+// zone data kept as a tree of names, so empty non-terminals are known
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// zoneTree holds the records of every zone by owner name. every ancestor of an
+// owner name has a node as well, so a name that only exists because something
+// below it has records (an empty non-terminal) can be told apart from a name
+// that does not exist at all
+type zoneTree struct {
+	mu     sync.RWMutex
+	nodes  map[string]*zoneNode
+	sorted []string          // owner names in canonical order, nil when it needs rebuilding
+	order  map[string]string // $ORDER policies by name, see order.go
+	// changes per zone apex for IXFR, oldest first, see journal.go
+	journal map[string][]zoneDelta
+}
+
+type zoneNode struct {
+	rrs   []rr
+	below int // number of owner names strictly below this one
+}
+
+func newZoneTree() *zoneTree {
+	return &zoneTree{nodes: make(map[string]*zoneNode), order: make(map[string]string), journal: make(map[string][]zoneDelta)}
+}
+
+// zoneFromMap builds a tree from owner name -> records
+func zoneFromMap(m map[string][]rr) *zoneTree {
+	t := newZoneTree()
+	for name, rrs := range m {
+		t.set(name, rrs)
+	}
+	return t
+}
+
+// parentName strips the first label: a.b.c. -> b.c., c. -> .
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	if parent == "" {
+		return "."
+	}
+	return parent
+}
+
+// get returns the records owned by name
+func (t *zoneTree) get(name string) []rr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if n := t.nodes[name]; n != nil {
+		return n.rrs
+	}
+	return nil
+}
+
+// exists reports whether name owns records or is an empty non-terminal
+func (t *zoneTree) exists(name string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.nodes[name]
+	return n != nil && (len(n.rrs) > 0 || n.below > 0)
+}
+
+// add appends a record to its owner name
+func (t *zoneTree) add(r rr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setLocked(r.Name, append(t.rrsLocked(r.Name), r))
+}
+
+// set replaces all records of name; no records removes the name
+func (t *zoneTree) set(name string, rrs []rr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setLocked(name, rrs)
+}
+
+func (t *zoneTree) rrsLocked(name string) []rr {
+	if n := t.nodes[name]; n != nil {
+		return n.rrs
+	}
+	return nil
+}
+
+func (t *zoneTree) setLocked(name string, rrs []rr) {
+	n := t.nodes[name]
+	had := n != nil && len(n.rrs) > 0
+	if len(rrs) > 0 && !had {
+		if n == nil {
+			n = &zoneNode{}
+			t.nodes[name] = n
+		}
+		// a new owner name: every ancestor gains a descendant
+		for p := name; p != "."; {
+			p = parentName(p)
+			pn := t.nodes[p]
+			if pn == nil {
+				pn = &zoneNode{}
+				t.nodes[p] = pn
+			}
+			pn.below++
+		}
+		t.sorted = nil
+	}
+	if len(rrs) == 0 && had {
+		for p := name; p != "."; {
+			p = parentName(p)
+			pn := t.nodes[p]
+			pn.below--
+			if pn.below == 0 && len(pn.rrs) == 0 {
+				delete(t.nodes, p)
+			}
+		}
+		if n.below == 0 {
+			delete(t.nodes, name)
+		}
+		t.sorted = nil
+	}
+	if n != nil {
+		n.rrs = rrs
+	}
+}
+
+// names returns every owner name in canonical order (RFC 4034 section 6.1)
+func (t *zoneTree) names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.namesLocked()
+}
+
+func (t *zoneTree) namesLocked() []string {
+	if t.sorted == nil {
+		t.sorted = []string{}
+		for name, n := range t.nodes {
+			if len(n.rrs) > 0 {
+				t.sorted = append(t.sorted, name)
+			}
+		}
+		sort.Slice(t.sorted, func(i, j int) bool { return canonicalLess(t.sorted[i], t.sorted[j]) })
+	}
+	return t.sorted
+}
+
+// namesBelow returns the owner names at or below apex, in canonical order
+func (t *zoneTree) namesBelow(apex string) []string {
+	var out []string
+	for _, name := range t.names() {
+		if isBelow(name, apex) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// snapshot returns every record of the zone at apex in canonical order, all
+// read under one lock so edits made meanwhile are either all in or all out.
+// the apex SOA comes first; child zones (names below another SOA) are left out
+func (t *zoneTree) snapshot(apex string) []rr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []rr
+	child := ""
+	for _, name := range t.namesLocked() {
+		if !isBelow(name, apex) || (child != "" && isBelow(name, child)) {
+			continue
+		}
+		rrs := t.nodes[name].rrs
+		if name != apex && hasType(rrs, type_soa) {
+			child = name
+			continue
+		}
+		out = append(out, rrs...)
+	}
+	// canonical order puts the apex first, move its SOA to the front
+	for i, r := range out {
+		if r.Type_ == type_soa {
+			copy(out[1:i+1], out[:i])
+			out[0] = r
+			break
+		}
+	}
+	return out
+}
+
+// hasType reports whether rrs has a record of type t
+func hasType(rrs []rr, t uint16) bool {
+	for _, r := range rrs {
+		if r.Type_ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalLess orders names by their labels compared right to left
+func canonicalLess(a, b string) bool {
+	la := strings.Split(strings.TrimSuffix(a, "."), ".")
+	lb := strings.Split(strings.TrimSuffix(b, "."), ".")
+	if a == "." {
+		la = nil
+	}
+	if b == "." {
+		lb = nil
+	}
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// replaceZone swaps every record of the zone at apex for records in one step,
+// for a secondary zone after a full transfer. child zones are left alone and
+// the IXFR journal of the zone is dropped since it no longer leads anywhere.
+// no records removes the zone
+func (t *zoneTree) replaceZone(apex string, records []rr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	byName := map[string][]rr{}
+	for _, r := range records {
+		byName[r.Name] = append(byName[r.Name], r)
+	}
+	child := ""
+	for _, name := range append([]string(nil), t.namesLocked()...) {
+		if !isBelow(name, apex) || (child != "" && isBelow(name, child)) {
+			continue
+		}
+		if name != apex && hasType(t.nodes[name].rrs, type_soa) {
+			child = name
+			continue
+		}
+		if _, ok := byName[name]; !ok {
+			t.setLocked(name, nil)
+		}
+	}
+	for name, rrs := range byName {
+		t.setLocked(name, rrs)
+	}
+	delete(t.journal, apex)
+}